@@ -0,0 +1,114 @@
+// Package awsretry configures how packrat's AWS clients retry failed requests and how fast they send them.
+package awsretry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const limiterHandlerName = "packrat.awsretry.Limiter"
+
+// Policy says how a client retries requests and how fast it sends them.
+//
+// Requests that are throttled, like DynamoDB's ProvisionedThroughputExceededException, and requests that fail with errors that might go away, like S3 5xx errors, are retried up to MaxRetries times.
+// The delay before each retry doubles from the minimum up to the maximum, with jitter so clients that were throttled together don't retry together.
+//
+// If RequestsPerSecond is more than 0, requests are held back to keep under that rate, with up to Burst of them sent at once. Retries count against the rate too.
+type Policy struct {
+	MaxRetries                         int
+	MinDelay, MaxDelay                 time.Duration // Delays for errors that might go away
+	MinThrottleDelay, MaxThrottleDelay time.Duration // Delays for throttling errors
+	RequestsPerSecond                  float64
+	Burst                              int
+}
+
+// DefaultPolicy retries enough to ride out throttling on a table with modest capacity, and doesn't limit the rate
+var DefaultPolicy = Policy{
+	MaxRetries:       10,
+	MinDelay:         50 * time.Millisecond,
+	MaxDelay:         20 * time.Second,
+	MinThrottleDelay: 500 * time.Millisecond,
+	MaxThrottleDelay: time.Minute,
+}
+
+// Apply makes a client follow a policy, replacing any policy it had before. Clients for AWS services embed *client.Client, like dynamodb.New(sess).Client.
+func Apply(c *client.Client, p Policy) {
+	c.Retryer = client.DefaultRetryer{
+		NumMaxRetries:    p.MaxRetries,
+		MinRetryDelay:    p.MinDelay,
+		MaxRetryDelay:    p.MaxDelay,
+		MinThrottleDelay: p.MinThrottleDelay,
+		MaxThrottleDelay: p.MaxThrottleDelay,
+	}
+
+	c.Handlers.Sign.RemoveByName(limiterHandlerName)
+	if p.RequestsPerSecond <= 0 {
+		return
+	}
+
+	l := newLimiter(p.RequestsPerSecond, p.Burst)
+
+	// Requests are signed before every attempt, so this runs for retries too
+	c.Handlers.Sign.PushFrontNamed(request.NamedHandler{
+		Name: limiterHandlerName,
+		Fn: func(r *request.Request) {
+			err := l.wait(r.Context())
+			if err != nil {
+				r.Error = err
+			}
+		},
+	})
+}
+
+// limiter spaces out events so there are no more than burst at once, and then one every interval
+type limiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	burst    int
+	next     time.Time // When the next event can happen if there is no burst left
+}
+
+func newLimiter(perSecond float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &limiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		burst:    burst,
+	}
+}
+
+// wait blocks until an event is allowed, or until ctx is done
+func (l *limiter) wait(ctx context.Context) error {
+	l.mutex.Lock()
+	now := time.Now()
+
+	// An idle limiter saves up to burst events
+	earliest := now.Add(-time.Duration(l.burst-1) * l.interval)
+	if l.next.Before(earliest) {
+		l.next = earliest
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,137 @@
+package awsretry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var testPolicy = Policy{
+	MaxRetries:       3,
+	MinDelay:         time.Millisecond,
+	MaxDelay:         5 * time.Millisecond,
+	MinThrottleDelay: time.Millisecond,
+	MaxThrottleDelay: 5 * time.Millisecond,
+}
+
+// throttlingServer acts like DynamoDB, throttling the first throttled requests
+func throttlingServer(throttled int32) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if atomic.AddInt32(&calls, 1) <= throttled {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException","message":"slow down"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	return srv, &calls
+}
+
+func testClient(endpoint string) *dynamodb.DynamoDB {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return dynamodb.New(sess)
+}
+
+func getItem(ddb *dynamodb.DynamoDB) error {
+	_, err := ddb.GetItem((&dynamodb.GetItemInput{}).
+		SetTableName("table").
+		SetKey(map[string]*dynamodb.AttributeValue{"Id": {S: aws.String("id")}}))
+	return err
+}
+
+func TestRetryThrottled(t *testing.T) {
+	srv, calls := throttlingServer(2)
+	defer srv.Close()
+
+	ddb := testClient(srv.URL)
+	Apply(ddb.Client, testPolicy)
+
+	err := getItem(ddb)
+	if err != nil {
+		t.Errorf("The request should have succeeded after being retried, got %v", err)
+	}
+
+	if *calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", *calls)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv, calls := throttlingServer(100)
+	defer srv.Close()
+
+	ddb := testClient(srv.URL)
+	Apply(ddb.Client, testPolicy)
+
+	err := getItem(ddb)
+	if err == nil {
+		t.Errorf("The request should have failed once it ran out of retries")
+	}
+
+	if *calls != int32(testPolicy.MaxRetries+1) {
+		t.Errorf("Expected %d calls, got %d", testPolicy.MaxRetries+1, *calls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv, _ := throttlingServer(0)
+	defer srv.Close()
+
+	p := testPolicy
+	p.RequestsPerSecond = 50
+	p.Burst = 2
+
+	ddb := testClient(srv.URL)
+	Apply(ddb.Client, p)
+
+	// 2 go right away, then the next 4 are 20ms apart
+	start := time.Now()
+	for n := 0; n < 6; n++ {
+		err := getItem(ddb)
+		if err != nil {
+			t.Fatalf("getItem returned an error: %v", err)
+		}
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < 70*time.Millisecond {
+		t.Errorf("6 requests at 50 per second with a burst of 2 should take about 80ms, took %v", elapsed)
+	}
+
+	// Applying a policy again replaces the limiter
+	Apply(ddb.Client, testPolicy)
+	start = time.Now()
+	for n := 0; n < 6; n++ {
+		getItem(ddb)
+	}
+	if time.Since(start) > 70*time.Millisecond {
+		t.Errorf("Requests should not be limited after the limit was removed, took %v", time.Since(start))
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := newLimiter(1, 1)
+	l.wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := l.wait(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("wait should have returned when its context was done, got %v", err)
+	}
+}
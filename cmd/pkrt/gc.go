@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/drocamor/packrat/index"
+	"github.com/drocamor/packrat/store"
+)
+
+// gcMarks records when each unreferenced blob was first seen, by store and then by score
+type gcMarks map[string]map[string]time.Time
+
+func readMarks(filename string) gcMarks {
+	marks := make(gcMarks)
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return marks
+	}
+
+	err = json.Unmarshal(b, &marks)
+	if err != nil {
+		log.Fatalf("Error reading marks file %q: %v", filename, err)
+	}
+
+	return marks
+}
+
+func writeMarks(filename string, marks gcMarks) {
+	b, err := json.MarshalIndent(marks, "", "  ")
+	if err != nil {
+		log.Fatal("Error encoding marks: ", err)
+	}
+
+	err = ioutil.WriteFile(filename, b, 0644)
+	if err != nil {
+		log.Fatal("Error writing marks file: ", err)
+	}
+}
+
+// emptyTrash purges the entries that have been in the trash for longer than retention
+func emptyTrash(retention time.Duration, dryRun bool) {
+	if dryRun {
+		entries, err := index.Trash(prIndex, retention)
+		if err != nil {
+			log.Fatal("Error listing trash: ", err)
+		}
+
+		for _, e := range entries {
+			log.Printf("purge %s (in the trash since %v)", e.Id, e.Deleted)
+		}
+		log.Printf("Dry run: would purge %d entries from the trash", len(entries))
+		return
+	}
+
+	purged, err := index.EmptyTrash(prIndex, retention)
+	for _, e := range purged {
+		log.Printf("purged %s (in the trash since %v)", e.Id, e.Deleted)
+	}
+	if err != nil {
+		log.Fatal("Error emptying trash: ", err)
+	}
+	log.Printf("Purged %d entries from the trash", len(purged))
+}
+
+// liveSet returns the scores of every blob referenced by an entry in the index, whatever kind of address refers to it.
+// The stores can be the same store, so a blob that any entry refers to is live in every store.
+// Entries in the trash still hold on to their blobs until they are purged.
+func liveSet() map[string]struct{} {
+	entries, err := prIndex.Query(index.Query{IncludeDeleted: true})
+	if err != nil {
+		log.Fatal("Error querying index: ", err)
+	}
+
+	live := make(map[string]struct{})
+	for _, e := range entries {
+		for _, a := range e.Addresses {
+			live[store.CanonicalScore(a.Score)] = struct{}{}
+		}
+	}
+
+	return live
+}
+
+// gc deletes blobs that no entry in the index refers to.
+//
+// Unreferenced blobs are marked the first time they are seen, and only deleted once they have been unreferenced for the grace period.
+// That keeps blobs that were just put, but whose entry hasn't been added to the index yet.
+//
+// Entries that have been in the trash for longer than the retention period are purged first, so their blobs can be collected.
+func gc(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be marked and deleted without changing anything")
+	grace := flags.Duration("grace", 30*24*time.Hour, "how long a blob must be unreferenced before it is deleted")
+	marksFile := flags.String("marks", "pkrt-gc-marks.json", "file to keep marks in between runs")
+	retention := flags.Duration("retention", index.DefaultRetention, "how long entries stay in the trash before they are purged")
+	flags.Parse(args)
+
+	emptyTrash(*retention, *dryRun)
+
+	stores := map[string]store.Store{
+		"orig":  origStore,
+		"thumb": thumbStore,
+	}
+
+	marks := readMarks(*marksFile)
+	live := liveSet()
+	now := time.Now()
+
+	var marked, held, deleted, deletedBytes int64
+	for kind, st := range stores {
+		storeMarks := make(map[string]time.Time)
+		err := st.Walk(func(a store.Address) bool {
+			if _, ok := live[store.CanonicalScore(a.Score)]; ok {
+				return true
+			}
+
+			first, ok := marks[kind][a.Score]
+			if !ok {
+				log.Printf("mark %s %s (%d bytes)", kind, a.Score, a.Size)
+				storeMarks[a.Score] = now
+				marked++
+				return true
+			}
+
+			if now.Sub(first) < *grace {
+				storeMarks[a.Score] = first
+				held++
+				return true
+			}
+
+			log.Printf("delete %s %s (%d bytes, unreferenced since %v)", kind, a.Score, a.Size, first)
+			if *dryRun {
+				storeMarks[a.Score] = first
+			} else {
+				err := st.Delete(a.Score)
+				if err != nil {
+					log.Printf("Error deleting %s %s: %v", kind, a.Score, err)
+					storeMarks[a.Score] = first
+					return true
+				}
+			}
+			deleted++
+			deletedBytes += a.Size
+			return true
+		})
+		if err != nil {
+			log.Fatalf("Error listing %q store: %v", kind, err)
+		}
+
+		// Blobs that are referenced again, or gone, drop out of the marks
+		marks[kind] = storeMarks
+	}
+
+	if *dryRun {
+		log.Printf("Dry run: would mark %d blobs, hold %d, and delete %d (%d bytes)", marked, held, deleted, deletedBytes)
+		return
+	}
+
+	writeMarks(*marksFile, marks)
+	log.Printf("Marked %d blobs, held %d, and deleted %d (%d bytes)", marked, held, deleted, deletedBytes)
+}
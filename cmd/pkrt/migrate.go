@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/drocamor/packrat/index"
+	"github.com/drocamor/packrat/store"
+)
+
+// mirrors are the mirror stores that openStore has opened, so repair can find them wherever they are in a store
+var mirrors []*store.MirrorStore
+
+// openStore makes a store from a spec like file:///path, aws://indextable/bucket, pack+aws://indextable/bucket to pack blobs into another store,
+// or mirror+file:///path,aws://indextable/bucket to mirror blobs to several stores
+func openStore(spec string) (store.ContextStore, error) {
+	if strings.HasPrefix(spec, "mirror+") {
+		var replicas []store.Store
+		for _, replicaSpec := range strings.Split(spec[len("mirror+"):], ",") {
+			st, err := openStore(replicaSpec)
+			if err != nil {
+				return nil, err
+			}
+			replicas = append(replicas, st)
+		}
+
+		// A majority of the replicas have to take a blob before Put returns
+		mirror := store.NewMirrorStore(len(replicas)/2+1, replicas...)
+
+		// The replicas that miss blobs are kept between runs, so pkrt repair can put them back
+		filename, err := missedFile(spec)
+		if err != nil {
+			log.Printf("Replicas that miss blobs in %q will only be repaired in this run: %v", spec, err)
+		} else {
+			mirror.SetMissedFile(filename)
+		}
+
+		mirrors = append(mirrors, mirror)
+		return mirror, nil
+	}
+
+	if strings.HasPrefix(spec, "pack+") {
+		st, err := openStore(spec[len("pack+"):])
+		if err != nil {
+			return nil, err
+		}
+		return store.NewPackStore(st, store.DefaultMaxPackSize), nil
+	}
+
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid store: %q", spec)
+	}
+
+	switch parts[0] {
+	case "file":
+		return store.NewFileStore(parts[1]), nil
+	case "aws":
+		tableAndBucket := strings.SplitN(parts[1], "/", 2)
+		if len(tableAndBucket) != 2 {
+			return nil, fmt.Errorf("Invalid aws store: %q", spec)
+		}
+		return store.NewAWSStore(awsSession(), tableAndBucket[0], tableAndBucket[1]), nil
+	}
+
+	return nil, fmt.Errorf("Unknown kind of store: %q", spec)
+}
+
+// missedFile returns the file that the mirror store in spec keeps the replicas that missed blobs in
+func missedFile(spec string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Join(dir, "pkrt")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(spec))
+	return filepath.Join(dir, fmt.Sprintf("mirror-%x.json", sum[:8])), nil
+}
+
+// migrateBlob copies a blob from src to dest, unless dest already has it, and returns its Address in dest
+func migrateBlob(src, dest store.Store, a store.Address) (store.Address, error) {
+	existing, err := dest.Describe(a.Score)
+	if err == nil {
+		return existing, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.GetAddress(a, pw))
+	}()
+
+	migrated, err := dest.Put(pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return migrated, err
+	}
+
+	// dest hashed the bytes as they arrived, so they are good if the score matches.
+	// A bad copy is left for gc, since dest might have had those bytes already.
+	if !store.SameBlob(migrated.Score, a.Score) || migrated.Size != a.Size {
+		return migrated, fmt.Errorf("Blob arrived as %q (%d bytes), expected %q (%d bytes)", migrated.Score, migrated.Size, a.Score, a.Size)
+	}
+
+	return migrated, nil
+}
+
+// migrateStore copies every blob from one of pkrt's stores to another store, and points the index at the copies.
+// It can be run again after it is interrupted, since blobs that were already copied are skipped.
+func migrateStore(args []string) {
+	flags := flag.NewFlagSet("migrate-store", flag.ExitOnError)
+	kind := flags.String("kind", "orig", "which store to migrate, orig or thumb")
+	to := flags.String("to", "", "store to copy blobs to, like file:///path, aws://indextable/bucket, pack+aws://indextable/bucket, or mirror+file:///path,aws://indextable/bucket")
+	workers := flags.Int("workers", 4, "how many blobs to copy at once")
+	rewrite := flags.Bool("rewrite-index", true, "point the index at the copies")
+	flags.Parse(args)
+
+	stores := map[string]store.Store{
+		"orig":  origStore,
+		"thumb": thumbStore,
+	}
+
+	src, ok := stores[*kind]
+	if !ok {
+		log.Fatalf("Unknown kind of store: %q", *kind)
+	}
+
+	dest, err := openStore(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blobs := make(chan store.Address)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	migrated := make(map[string]store.Address)
+	failed := 0
+
+	for n := 0; n < *workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range blobs {
+				m, err := migrateBlob(src, dest, a)
+
+				mutex.Lock()
+				if err != nil {
+					log.Printf("Error migrating %s: %v", a.Score, err)
+					failed++
+				} else {
+					migrated[a.Score] = m
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	err = src.Walk(func(a store.Address) bool {
+		blobs <- a
+		return true
+	})
+	close(blobs)
+	wg.Wait()
+
+	if err != nil {
+		log.Fatal("Error listing blobs: ", err)
+	}
+
+	// Stores like PackStore hold on to blobs, so make sure they are written before the index points at them
+	if f, ok := dest.(store.Flusher); ok {
+		err = f.Flush()
+		if err != nil {
+			log.Fatal("Error flushing blobs: ", err)
+		}
+	}
+
+	log.Printf("Migrated %d blobs, %d failed", len(migrated), failed)
+
+	if *rewrite {
+		rewriteAddresses(*kind, migrated)
+		log.Printf("Set PKRT_%s_STORE=%s so pkrt reads from the copies", strings.ToUpper(*kind), *to)
+	}
+
+	if failed > 0 {
+		log.Fatal("Some blobs were not migrated, run migrate-store again to retry them")
+	}
+}
+
+// rewriteAddresses points the entries in the index at migrated blobs
+func rewriteAddresses(kind string, migrated map[string]store.Address) {
+	// Entries in the trash might be restored, so they are pointed at the copies too
+	entries, err := prIndex.Query(index.Query{IncludeDeleted: true})
+	if err != nil {
+		log.Fatal("Error querying index: ", err)
+	}
+
+	rewritten := 0
+	for _, e := range entries {
+		a, ok := e.Addresses[kind]
+		if !ok {
+			continue
+		}
+
+		m, ok := migrated[a.Score]
+		if !ok || m == a {
+			continue
+		}
+
+		err := prIndex.SetAddress(e.Id, kind, m)
+		if err != nil {
+			log.Fatalf("Error rewriting address of %q: %v", e.Id, err)
+		}
+		rewritten++
+	}
+
+	log.Printf("Rewrote %d addresses in the index", rewritten)
+}
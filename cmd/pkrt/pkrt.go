@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,11 +20,86 @@ import (
 )
 
 var (
-	prIndex    index.Index
-	thumbStore store.Store
-	origStore  store.Store
+	sess       *session.Session
+	prIndex    index.ContextIndex
+	thumbStore store.ContextStore
+	origStore  store.ContextStore
 )
 
+const (
+	defaultIndex      = "ddb://rocamora/testPR"
+	defaultIndexGroup = "rocamora" // The group of a bolt index whose spec doesn't name one
+	defaultOrigStore  = "aws://testPRStoreIndex/testprstore"
+	defaultThumbStore = "aws://testPRThumbIndex/testprthumbs"
+)
+
+// awsSession returns the AWS session, making it the first time an index or store needs it, so pkrt can run without AWS when nothing uses it
+func awsSession() *session.Session {
+	if sess == nil {
+		sess = session.Must(session.NewSession(&aws.Config{Region: aws.String("us-west-2")}))
+	}
+	return sess
+}
+
+// openIndex makes an index from a spec like ddb://group/tableprefix, or bolt://group/path/to/index.db for an index in a local file.
+// bolt:///path/to/index.db uses the default group.
+func openIndex(spec string) (index.ContextIndex, error) {
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid index: %q", spec)
+	}
+
+	groupAndRest := strings.SplitN(parts[1], "/", 2)
+	if len(groupAndRest) != 2 || groupAndRest[1] == "" {
+		return nil, fmt.Errorf("Invalid index: %q", spec)
+	}
+	group, rest := groupAndRest[0], groupAndRest[1]
+
+	switch parts[0] {
+	case "ddb":
+		if group == "" {
+			return nil, fmt.Errorf("Invalid ddb index, it needs a group: %q", spec)
+		}
+		return index.NewDynamoDBIndex(awsSession(), group, rest), nil
+	case "bolt":
+		if group == "" {
+			group = defaultIndexGroup
+		}
+		return index.NewBoltIndex("/"+rest, group)
+	}
+
+	return nil, fmt.Errorf("Unknown kind of index: %q", spec)
+}
+
+// indexFromEnv opens the index in the environment variable name, or def if it isn't set
+func indexFromEnv(name, def string) index.ContextIndex {
+	spec := os.Getenv(name)
+	if spec == "" {
+		spec = def
+	}
+
+	idx, err := openIndex(spec)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v", name, err)
+	}
+	return idx
+}
+
+// storeFromEnv opens the store in the environment variable name, or def if it isn't set.
+// After migrate-store, point the variable at the new store so the addresses it wrote can be read.
+func storeFromEnv(name, def string) store.ContextStore {
+	spec := os.Getenv(name)
+	if spec == "" {
+		spec = def
+	}
+
+	st, err := openStore(spec)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v", name, err)
+	}
+	return st
+}
+
 type putStoreAsyncResult struct {
 	address store.Address
 	err     error
@@ -30,20 +108,56 @@ type putStoreAsyncResult struct {
 func main() {
 
 	if len(os.Args) < 2 {
-		log.Fatal("Usage: pkrt [files]")
+		log.Fatal("Usage: pkrt [files] | pkrt scrub [flags] | pkrt gc [flags] | pkrt migrate-store [flags] | pkrt rehash [flags] | pkrt repair")
 	}
 
-	filenames := os.Args[1:]
+	// Set up the index, the original store, and the thumbnail store. They can be set with PKRT_INDEX, PKRT_ORIG_STORE and PKRT_THUMB_STORE.
+	prIndex = indexFromEnv("PKRT_INDEX", defaultIndex)
+	thumbStore = storeFromEnv("PKRT_THUMB_STORE", defaultThumbStore)
+	origStore = storeFromEnv("PKRT_ORIG_STORE", defaultOrigStore)
+
+	switch os.Args[1] {
+	case "scrub":
+		scrub(os.Args[2:])
+	case "gc":
+		gc(os.Args[2:])
+	case "migrate-store":
+		migrateStore(os.Args[2:])
+	case "rehash":
+		rehash(os.Args[2:])
+	case "repair":
+		repair()
+	default:
+		// Ctrl-C cancels the uploads and index calls that are in flight
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		importFiles(ctx, os.Args[1:])
+	}
+}
+
+// importBatchSize is how many files are imported between flushes of stores that hold on to blobs, like PackStore
+const importBatchSize = 100
+
+// importFiles keeps going when a file fails, since requests that could be retried already were. The files that failed are listed at the end.
+//
+// Entries are only added to the index once the stores have flushed their blobs, so a crash never leaves the index pointing at blobs that were still in a local pack.
+// Stores that hold on to blobs get a batch of files at a time, and other stores get one.
+func importFiles(ctx context.Context, filenames []string) {
+	failed := make([]string, 0)
+	pending := make([]index.Entry, 0)
 
-	// Set up the index, the original store, and the thumbnail store
-	// TODO make this configurable
-	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-west-2")}))
-	prIndex = index.NewDynamoDBIndex(sess, "rocamora", "testPR")
-	thumbStore = store.NewAWSStore(sess, "testPRThumbIndex", "testprthumbs")
-	origStore = store.NewAWSStore(sess, "testPRStoreIndex", "testprstore")
+	batch := 1
+	if bufferedStores() {
+		batch = importBatchSize
+	}
 
 	// Take a list of files from the args
 	for i := 0; i < len(filenames); i++ {
+		if ctx.Err() != nil {
+			addEntries(pending)
+			waitMirrors()
+			log.Fatalf("Import interrupted, %q and the files after it were not imported", filenames[i])
+		}
 
 		// Determine if it is an image - if not, skip it and log it
 		if !isImage(filenames[i]) {
@@ -52,18 +166,86 @@ func main() {
 		}
 
 		// Process each file in the list
-		err := process(filenames[i])
+		entry, err := process(ctx, filenames[i])
 		if err != nil {
-			if err == index.ErrAlreadyExists {
-				log.Printf("File %q was already in the index", filenames[i])
-			} else {
-				log.Fatal("Error adding entry to index: ", err)
+			if ctx.Err() != nil {
+				addEntries(pending)
+				waitMirrors()
+				log.Fatalf("Import interrupted, %q and the files after it were not imported", filenames[i])
 			}
+
+			log.Printf("Error importing %q: %v", filenames[i], err)
+			failed = append(failed, filenames[i])
+			continue
 		}
+
+		pending = append(pending, entry)
+		if len(pending) >= batch {
+			failed = append(failed, addEntries(pending)...)
+			pending = pending[:0]
+		}
+	}
+
+	failed = append(failed, addEntries(pending)...)
+	waitMirrors()
+
+	if len(failed) > 0 {
+		log.Fatalf("%d files were not imported: %s", len(failed), strings.Join(failed, " "))
 	}
 
 }
 
+// bufferedStores tells if any of the stores hold on to blobs until they are flushed
+func bufferedStores() bool {
+	for _, st := range []store.Store{origStore, thumbStore} {
+		if _, ok := st.(store.Flusher); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flushStores writes the blobs that stores like PackStore are holding on to
+func flushStores() {
+	for _, st := range []store.Store{origStore, thumbStore} {
+		if f, ok := st.(store.Flusher); ok {
+			err := f.Flush()
+			if err != nil {
+				log.Fatal("Error flushing blobs, the files imported by this run may be missing: ", err)
+			}
+		}
+	}
+}
+
+// waitMirrors waits for mirror stores to finish writing to their slower replicas, so the replicas that miss blobs are recorded for pkrt repair
+func waitMirrors() {
+	for _, mirror := range mirrors {
+		mirror.Wait()
+	}
+}
+
+// addEntries flushes the stores and then adds the entries, whose blobs are all in the stores by then. It returns the names of the files whose entries couldn't be added.
+//
+// The entries are added even if the import was interrupted, since their blobs are already stored.
+func addEntries(entries []index.Entry) []string {
+	flushStores()
+
+	failed := make([]string, 0)
+	for _, entry := range entries {
+		err := prIndex.AddContext(context.Background(), entry)
+		if err == index.ErrAlreadyExists {
+			log.Printf("File %q was already in the index", entry.Name)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error adding %q to the index: %v", entry.Name, err)
+			failed = append(failed, entry.Name)
+		}
+	}
+
+	return failed
+}
+
 func isImage(filename string) bool {
 	cmd := exec.Command("/usr/bin/identify", filename)
 	err := cmd.Run()
@@ -73,8 +255,9 @@ func isImage(filename string) bool {
 	return true
 }
 
-func putStoreAsync(st store.Store, filename string) chan putStoreAsyncResult {
-	c := make(chan putStoreAsyncResult)
+func putStoreAsync(ctx context.Context, st store.ContextStore, filename string) chan putStoreAsyncResult {
+	// Buffered so the upload can finish and exit even if nobody waits for it, like when the thumbnail can't be made
+	c := make(chan putStoreAsyncResult, 1)
 
 	go func() {
 		var result putStoreAsyncResult
@@ -85,22 +268,20 @@ func putStoreAsync(st store.Store, filename string) chan putStoreAsyncResult {
 			return
 		}
 		defer f.Close()
-		a, err := st.Put(f)
-		result.address = a
-		result.err = err
+		result.address, result.err = st.PutContext(ctx, f)
 		c <- result
 	}()
 
 	return c
 }
 
-func createThumb(filename string) (string, error) {
+func createThumb(ctx context.Context, filename string) (string, error) {
 	tmp, err := ioutil.TempFile("", "pkrt-thumb*.jpg")
 	if err != nil {
 		return "", err
 	}
 	log.Printf("thumb file is %q", tmp.Name())
-	cmd := exec.Command("/usr/bin/convert", "-resize", "480000@", filename, tmp.Name())
+	cmd := exec.CommandContext(ctx, "/usr/bin/convert", "-resize", "480000@", filename, tmp.Name())
 	err = cmd.Run()
 
 	return tmp.Name(), err
@@ -147,20 +328,21 @@ func tsAndLocation(filename string) (time.Time, string) {
 	return ts, gs
 }
 
-func process(filename string) error {
+// process uploads a file and its thumbnail, and returns the entry to add to the index for it
+func process(ctx context.Context, filename string) (index.Entry, error) {
 
 	// Start uploading the image
-	origUploadChan := putStoreAsync(origStore, filename)
+	origUploadChan := putStoreAsync(ctx, origStore, filename)
 
 	// Create a thumbnail
-	thumbFilename, err := createThumb(filename)
+	thumbFilename, err := createThumb(ctx, filename)
 	defer os.Remove(thumbFilename)
 	if err != nil {
-		return err
+		return index.Entry{}, err
 	}
 
 	// start uploading the thumbnail
-	thumbUploadChan := putStoreAsync(thumbStore, thumbFilename)
+	thumbUploadChan := putStoreAsync(ctx, thumbStore, thumbFilename)
 
 	// Use exif to determine date and location
 	ts, gridsquare := tsAndLocation(filename)
@@ -170,15 +352,14 @@ func process(filename string) error {
 	thumbResult := <-thumbUploadChan
 
 	if origResult.err != nil {
-		return fmt.Errorf("Error uploading original: %v", err)
+		return index.Entry{}, fmt.Errorf("Error uploading original: %v", origResult.err)
 	}
 
 	if thumbResult.err != nil {
-		return fmt.Errorf("Error uploading original: %v", err)
+		return index.Entry{}, fmt.Errorf("Error uploading thumbnail: %v", thumbResult.err)
 	}
 
-	// Create an entry in the index
-	entry := index.Entry{
+	return index.Entry{
 		Name:       filename,
 		Timestamp:  ts,
 		Gridsquare: gridsquare,
@@ -187,7 +368,5 @@ func process(filename string) error {
 			"orig":  origResult.address,
 			"thumb": thumbResult.address,
 		},
-	}
-
-	return prIndex.Add(entry)
+	}, nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"time"
+
+	"github.com/drocamor/packrat/store"
+)
+
+// rehashBlob reads a blob once, checking it against its score while it is hashed with algorithm, and returns the new score
+func rehashBlob(st store.Store, a store.Address, algorithm string) (string, error) {
+	h, err := store.NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(store.VerifiedCopy(st, a, pw))
+	}()
+
+	_, err = io.Copy(h, pr)
+	if err != nil {
+		return "", err
+	}
+
+	return store.FormatScore(algorithm, h.Sum(nil)), nil
+}
+
+// rehash adds scores made with another hash algorithm to every blob in one of pkrt's stores, so blobs can be found by either score.
+// Every blob is checked against its old score while it is read. Adding an alias twice is harmless, so it can be run again after it is interrupted.
+func rehash(args []string) {
+	flags := flag.NewFlagSet("rehash", flag.ExitOnError)
+	kind := flags.String("kind", "orig", "which store to rehash, orig or thumb")
+	algorithm := flags.String("algorithm", "sha512", "hash algorithm for the new scores")
+	rate := flags.Int64("rate", 0, "maximum bytes per second to read from the store, 0 for no limit")
+	flags.Parse(args)
+
+	stores := map[string]store.Store{
+		"orig":  origStore,
+		"thumb": thumbStore,
+	}
+
+	st, ok := stores[*kind]
+	if !ok {
+		log.Fatalf("Unknown kind of store: %q", *kind)
+	}
+
+	aliaser, ok := st.(store.Aliaser)
+	if !ok {
+		log.Fatalf("The %q store can't add aliases", *kind)
+	}
+
+	_, err := store.NewHash(*algorithm)
+	if err != nil {
+		log.Fatalf("%v: %q", err, *algorithm)
+	}
+
+	limiter := rateLimiter{rate: *rate, start: time.Now()}
+	var added, skipped, failed int
+
+	err = st.Walk(func(a store.Address) bool {
+		current, _, err := store.ParseScore(a.Score)
+		if err == nil && current == *algorithm {
+			skipped++
+			return true
+		}
+
+		newScore, err := rehashBlob(st, a, *algorithm)
+		limiter.wait(a.Size)
+		if err == nil {
+			err = aliaser.AddAlias(a.Score, newScore)
+		}
+
+		if err != nil {
+			log.Printf("Error rehashing %s: %v", a.Score, err)
+			failed++
+			return true
+		}
+
+		log.Printf("%s is also %s", a.Score, newScore)
+		added++
+		return true
+	})
+	if err != nil {
+		log.Fatalf("Error listing %q store: %v", *kind, err)
+	}
+
+	log.Printf("Added %d aliases, skipped %d blobs already scored with %s, %d failed", added, skipped, *algorithm, failed)
+
+	if failed > 0 {
+		log.Fatalf("%d blobs could not be rehashed, run rehash again to retry them", failed)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+)
+
+// repair puts the blobs that mirror stores couldn't write to every replica into the replicas that missed them, in this run or an earlier one
+func repair() {
+	if len(mirrors) == 0 {
+		log.Print("No mirror stores to repair")
+		return
+	}
+
+	failed := false
+	for _, mirror := range mirrors {
+		err := mirror.Repair()
+		if err != nil {
+			log.Print("Error repairing mirror store: ", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		log.Fatal("Some blobs could not be repaired, run repair again once the replicas are back")
+	}
+	log.Printf("Repaired %d mirror stores", len(mirrors))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drocamor/packrat/store"
+)
+
+// rateLimiter sleeps to keep the bytes read under a rate
+type rateLimiter struct {
+	rate  int64 // bytes per second, 0 means no limit
+	start time.Time
+	bytes int64
+}
+
+func (r *rateLimiter) wait(n int64) {
+	if r.rate <= 0 {
+		return
+	}
+
+	r.bytes += n
+	due := r.start.Add(time.Duration(float64(r.bytes) / float64(r.rate) * float64(time.Second)))
+	time.Sleep(time.Until(due))
+}
+
+// scrubCursor is how far a scrub got: the store it was checking, and the last score it checked in that store
+type scrubCursor struct {
+	kind, score string
+}
+
+// readProgress returns where a previous scrub stopped, or an empty cursor to start from the beginning
+func readProgress(filename string) scrubCursor {
+	var c scrubCursor
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return c
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		log.Printf("Ignoring progress file %q, it should have a store and a score", filename)
+		return c
+	}
+
+	c.kind, c.score = fields[0], fields[1]
+	return c
+}
+
+func writeProgress(filename string, c scrubCursor) {
+	err := ioutil.WriteFile(filename, []byte(c.kind+" "+c.score+"\n"), 0644)
+	if err != nil {
+		log.Printf("Error writing progress file: %v", err)
+	}
+}
+
+// scrubStore is a store a scrub checks, by the kind of address it holds
+type scrubStore struct {
+	kind string
+	st   store.Store
+}
+
+// sortedBlobs walks a store and returns its blobs in order of their canonical scores, so a scrub can resume after the last one it checked
+func sortedBlobs(st store.Store) ([]store.Address, error) {
+	blobs := make([]store.Address, 0)
+	err := st.Walk(func(a store.Address) bool {
+		blobs = append(blobs, a)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return store.CanonicalScore(blobs[i].Score) < store.CanonicalScore(blobs[j].Score)
+	})
+	return blobs, nil
+}
+
+// errScrubFailed counts the blobs that couldn't be checked, like when the store couldn't be reached
+var errScrubFailed = errors.New("Could not be checked")
+
+// scrubProblems are the kinds of problems a scrub counts, in the order they are reported
+var scrubProblems = []error{store.ErrNotExist, store.ErrTruncated, store.ErrCorrupt, errScrubFailed}
+
+// scrubProblem returns the kind of problem err is
+func scrubProblem(err error) error {
+	for _, problem := range scrubProblems {
+		if errors.Is(err, problem) {
+			return problem
+		}
+	}
+	return errScrubFailed
+}
+
+// scrub re-reads every blob in the stores and checks that its bytes still match its Score.
+// Every blob is checked, including the blobs of entries in the trash and blobs that no entry refers to.
+func scrub(args []string) {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	progress := flags.String("progress", "", "file to record progress in, so an interrupted scrub can resume")
+	rate := flags.Int64("rate", 0, "maximum bytes per second to read from the stores, 0 for no limit")
+	flags.Parse(args)
+
+	stores := []scrubStore{
+		{"orig", origStore},
+		{"thumb", thumbStore},
+	}
+
+	var cursor scrubCursor
+	if *progress != "" {
+		cursor = readProgress(*progress)
+		if cursor.kind != "" {
+			log.Printf("Resuming scrub of the %q store after %s", cursor.kind, cursor.score)
+		}
+	}
+
+	limiter := rateLimiter{rate: *rate, start: time.Now()}
+	counts := make(map[error]int)
+	checked := 0
+
+	// Stores before the one the cursor is in were already finished
+	resuming := false
+	for _, ss := range stores {
+		if ss.kind == cursor.kind {
+			resuming = true
+		}
+	}
+	for _, ss := range stores {
+		if resuming && ss.kind != cursor.kind {
+			continue
+		}
+
+		blobs, err := sortedBlobs(ss.st)
+		if err != nil {
+			log.Fatalf("Error listing %q store: %v", ss.kind, err)
+		}
+
+		for _, a := range blobs {
+			score := store.CanonicalScore(a.Score)
+			if resuming && score <= cursor.score {
+				continue
+			}
+
+			err := store.Verify(ss.st, a)
+			limiter.wait(a.Size)
+			checked++
+
+			if err != nil {
+				counts[scrubProblem(err)]++
+				log.Printf("%v: %q store, score %s at %q", err, ss.kind, a.Score, a.Location)
+			}
+
+			if *progress != "" {
+				writeProgress(*progress, scrubCursor{ss.kind, score})
+			}
+		}
+		resuming = false
+	}
+
+	// The scrub finished, so the next one starts over
+	if *progress != "" {
+		os.Remove(*progress)
+	}
+
+	problems := 0
+	for _, err := range scrubProblems {
+		n := counts[err]
+		if n == 0 {
+			continue
+		}
+
+		log.Printf("%d blobs: %s", n, err)
+		problems += n
+	}
+	log.Printf("Checked %d blobs, found %d problems", checked, problems)
+
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
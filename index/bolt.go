@@ -0,0 +1,758 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/drocamor/packrat/store"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+/*
+Entries: id -> entry
+Gridsquares: gridsquareid -> id
+ExactGridsquares: gridsquare, id -> id
+
+Aliases: alias -> id
+Relations: id, otherid
+Related: otherid, id
+History: id, version -> entry
+
+*/
+
+var (
+	entriesBucket     = []byte("Entries")
+	gridsquaresBucket = []byte("Gridsquares")
+	exactBucket       = []byte("ExactGridsquares") // The entries in each gridsquare, without the squares inside it
+	aliasesBucket     = []byte("Aliases")
+	relationsBucket   = []byte("Relations")
+	relatedBucket     = []byte("Related") // The relations table turned around, so the relations to an entry can be found without a scan
+	historyBucket     = []byte("History")
+)
+
+// keySeparator separates the parts of keys that are made of more than one thing. It sorts before anything that can be in an Id.
+const keySeparator = "\x00"
+
+// BoltIndex is an Index that is kept in a single file with bbolt, for installs that run without DynamoDB.
+//
+// It is laid out like DynamoDBIndex. Entries are keyed by Id, so they are in time order, and every write happens in one transaction.
+type BoltIndex struct {
+	db    *bolt.DB
+	group string
+}
+
+// NewBoltIndex opens the index in the file at path, creating it if it doesn't exist. Only one process can have the file open at a time.
+func NewBoltIndex(path string, group string) (*BoltIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Files from before the exact gridsquare bucket need it filled in
+		fillExact := tx.Bucket(entriesBucket) != nil && tx.Bucket(exactBucket) == nil
+
+		for _, name := range [][]byte{entriesBucket, gridsquaresBucket, exactBucket, aliasesBucket, relationsBucket, relatedBucket, historyBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if fillExact {
+			return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+				var e Entry
+				err := json.Unmarshal(v, &e)
+				if err != nil || e.Gridsquare == "" {
+					return err
+				}
+				return tx.Bucket(exactBucket).Put(pairKey(e.Gridsquare, e.Id), []byte(e.Id))
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltIndex{
+		db:    db,
+		group: group,
+	}, nil
+}
+
+// Close closes the file. The index can't be used after it is closed.
+func (i *BoltIndex) Close() error {
+	return i.db.Close()
+}
+
+// pairKey returns the key for a relation between a and b
+func pairKey(a, b string) []byte {
+	return []byte(a + keySeparator + b)
+}
+
+// historyKey returns the key for a version of an entry in the history. Versions are big endian so they sort in order.
+func historyKey(id string, version int) []byte {
+	key := make([]byte, len(id)+len(keySeparator)+8)
+	copy(key, id+keySeparator)
+	binary.BigEndian.PutUint64(key[len(id)+len(keySeparator):], uint64(version))
+	return key
+}
+
+// prefixKeys returns copies of the keys in b that start with prefix, so they can be deleted while they are used
+func prefixKeys(b *bolt.Bucket, prefix []byte) [][]byte {
+	keys := make([][]byte, 0)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+func getEntry(tx *bolt.Tx, id string) (Entry, error) {
+	var e Entry
+
+	v := tx.Bucket(entriesBucket).Get([]byte(id))
+	if v == nil {
+		return e, ErrNotFound
+	}
+
+	err := json.Unmarshal(v, &e)
+	return e, err
+}
+
+// putEntry writes an entry and its gridsquare keys
+func putEntry(tx *bolt.Tx, e Entry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(entriesBucket).Put([]byte(e.Id), v)
+	if err != nil {
+		return err
+	}
+
+	if e.GridsquareId == "" {
+		return nil
+	}
+
+	err = tx.Bucket(exactBucket).Put(pairKey(e.Gridsquare, e.Id), []byte(e.Id))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(gridsquaresBucket).Put([]byte(e.GridsquareId), []byte(e.Id))
+}
+
+// deleteEntry removes an entry and its gridsquare keys
+func deleteEntry(tx *bolt.Tx, e Entry) error {
+	err := tx.Bucket(entriesBucket).Delete([]byte(e.Id))
+	if err != nil {
+		return err
+	}
+
+	if e.GridsquareId == "" {
+		return nil
+	}
+
+	err = tx.Bucket(exactBucket).Delete(pairKey(e.Gridsquare, e.Id))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(gridsquaresBucket).Delete([]byte(e.GridsquareId))
+}
+
+// putHistory keeps an earlier version of an entry in the history of the entry at id
+func putHistory(tx *bolt.Tx, id string, e Entry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(historyBucket).Put(historyKey(id, e.Version), v)
+}
+
+// change applies fn to an entry and writes it back as its next version, keeping the version it was at in the history, in one transaction
+func (i *BoltIndex) change(ctx context.Context, id string, fn func(e *Entry)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		e, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+
+		changed := e
+		fn(&changed)
+		changed.Version++
+
+		err = deleteEntry(tx, e)
+		if err != nil {
+			return err
+		}
+
+		err = putEntry(tx, changed)
+		if err != nil {
+			return err
+		}
+		return putHistory(tx, id, e)
+	})
+}
+
+func (i *BoltIndex) Add(entry Entry) error {
+	return i.AddContext(context.Background(), entry)
+}
+
+func (i *BoltIndex) AddContext(ctx context.Context, entry Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entry.Group = i.group
+	entry.createIds()
+	if entry.Version == 0 {
+		entry.Version = 1
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(entriesBucket).Get([]byte(entry.Id)) != nil {
+			return ErrAlreadyExists
+		}
+		return putEntry(tx, entry)
+	})
+}
+
+func (i *BoltIndex) Get(id string) (Entry, error) {
+	return i.GetContext(context.Background(), id)
+}
+
+func (i *BoltIndex) GetContext(ctx context.Context, id string) (Entry, error) {
+	var e Entry
+	if err := ctx.Err(); err != nil {
+		return e, err
+	}
+
+	err := i.db.View(func(tx *bolt.Tx) error {
+		var err error
+		e, err = getEntry(tx, id)
+		return err
+	})
+	return e, err
+}
+
+func (i *BoltIndex) Exists(id string) bool {
+	return i.ExistsContext(context.Background(), id)
+}
+
+func (i *BoltIndex) ExistsContext(ctx context.Context, id string) bool {
+	_, err := i.GetContext(ctx, id)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+func (i *BoltIndex) SetAddress(id, key string, a store.Address) error {
+	return i.SetAddressContext(context.Background(), id, key, a)
+}
+
+func (i *BoltIndex) SetAddressContext(ctx context.Context, id, key string, a store.Address) error {
+	return i.change(ctx, id, func(e *Entry) {
+		// Copy the map so the version in the history keeps the old address
+		addresses := make(map[string]store.Address)
+		for k, v := range e.Addresses {
+			addresses[k] = v
+		}
+		addresses[key] = a
+		e.Addresses = addresses
+	})
+}
+
+func (i *BoltIndex) Alias(alias, id string) error {
+	return i.AliasContext(context.Background(), alias, id)
+}
+
+func (i *BoltIndex) AliasContext(ctx context.Context, alias, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		_, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+
+		aliases := tx.Bucket(aliasesBucket)
+		if aliases.Get([]byte(alias)) != nil {
+			return ErrAliasExists
+		}
+		return aliases.Put([]byte(alias), []byte(id))
+	})
+}
+
+func (i *BoltIndex) GetAlias(alias string) (Entry, error) {
+	return i.GetAliasContext(context.Background(), alias)
+}
+
+func (i *BoltIndex) GetAliasContext(ctx context.Context, alias string) (Entry, error) {
+	var e Entry
+	if err := ctx.Err(); err != nil {
+		return e, err
+	}
+
+	err := i.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(aliasesBucket).Get([]byte(alias))
+		if id == nil {
+			return ErrAliasNotFound
+		}
+
+		var err error
+		e, err = getEntry(tx, string(id))
+		return err
+	})
+	return e, err
+}
+
+func (i *BoltIndex) UnAlias(alias string) error {
+	return i.UnAliasContext(context.Background(), alias)
+}
+
+func (i *BoltIndex) UnAliasContext(ctx context.Context, alias string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(aliasesBucket).Delete([]byte(alias))
+	})
+}
+
+func (i *BoltIndex) Relate(a, b string) error {
+	return i.RelateContext(context.Background(), a, b)
+}
+
+func (i *BoltIndex) RelateContext(ctx context.Context, a, b string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range []string{a, b} {
+			_, err := getEntry(tx, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return relate(tx, a, b)
+	})
+}
+
+func relate(tx *bolt.Tx, a, b string) error {
+	err := tx.Bucket(relationsBucket).Put(pairKey(a, b), []byte{})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(relatedBucket).Put(pairKey(b, a), []byte{})
+}
+
+func unRelate(tx *bolt.Tx, a, b string) error {
+	err := tx.Bucket(relationsBucket).Delete(pairKey(a, b))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(relatedBucket).Delete(pairKey(b, a))
+}
+
+// relationsOf returns the other halves of the keys in bucket that start with id
+func relationsOf(tx *bolt.Tx, bucket []byte, id string) []string {
+	prefix := pairKey(id, "")
+	results := make([]string, 0)
+	for _, k := range prefixKeys(tx.Bucket(bucket), prefix) {
+		results = append(results, string(k[len(prefix):]))
+	}
+	return results
+}
+
+func (i *BoltIndex) UnRelate(a, b string) error {
+	return i.UnRelateContext(context.Background(), a, b)
+}
+
+func (i *BoltIndex) UnRelateContext(ctx context.Context, a, b string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return unRelate(tx, a, b)
+	})
+}
+
+func (i *BoltIndex) Relations(id string) ([]string, error) {
+	return i.RelationsContext(context.Background(), id)
+}
+
+func (i *BoltIndex) RelationsContext(ctx context.Context, id string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var relations []string
+	err := i.db.View(func(tx *bolt.Tx) error {
+		relations = relationsOf(tx, relationsBucket, id)
+		return nil
+	})
+	return relations, err
+}
+
+func (i *BoltIndex) Query(q Query) ([]Entry, error) {
+	return i.QueryContext(context.Background(), q)
+}
+
+// QueryContext walks the entries in the range of Ids that could match q, the same way DynamoDBIndex queries its table
+func (i *BoltIndex) QueryContext(ctx context.Context, q Query) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start, end := idRange(q)
+	results := make([]Entry, 0)
+
+	err := i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && string(k) <= end; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var e Entry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+
+			if q.matches(e) {
+				results = append(results, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortByTimestamp(results)
+
+	return results, nil
+}
+
+func (i *BoltIndex) QueryGridsquare(gridsquare string, q Query) ([]Entry, error) {
+	return i.QueryGridsquareContext(context.Background(), gridsquare, q)
+}
+
+func (i *BoltIndex) QueryGridsquareContext(ctx context.Context, gridsquare string, q Query) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if gridsquare == "" {
+		return nil, ErrNoGridsquare
+	}
+
+	results := make([]Entry, 0)
+
+	err := i.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(gridsquare)
+		b := tx.Bucket(gridsquaresBucket)
+		if q.ExactGridsquare {
+			prefix = pairKey(gridsquare, "")
+			b = tx.Bucket(exactBucket)
+		}
+
+		c := b.Cursor()
+		for k, id := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			e, err := getEntry(tx, string(id))
+			if err != nil {
+				return err
+			}
+
+			if q.matches(e) {
+				results = append(results, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortByTimestamp(results)
+
+	return results, nil
+}
+
+func (i *BoltIndex) Delete(id string) error {
+	return i.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext keeps the time an entry was first moved to the trash if it is deleted again
+func (i *BoltIndex) DeleteContext(ctx context.Context, id string) error {
+	return i.change(ctx, id, func(e *Entry) {
+		if e.Deleted == nil {
+			now := time.Now()
+			e.Deleted = &now
+		}
+	})
+}
+
+func (i *BoltIndex) Restore(id string) error {
+	return i.RestoreContext(context.Background(), id)
+}
+
+func (i *BoltIndex) RestoreContext(ctx context.Context, id string) error {
+	return i.change(ctx, id, func(e *Entry) {
+		e.Deleted = nil
+	})
+}
+
+func (i *BoltIndex) Purge(id string) error {
+	return i.PurgeContext(context.Background(), id)
+}
+
+func (i *BoltIndex) PurgeContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		e, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+
+		err = deleteEntry(tx, e)
+		if err != nil {
+			return err
+		}
+
+		err = moveAliases(tx, id, "")
+		if err != nil {
+			return err
+		}
+
+		for _, b := range relationsOf(tx, relationsBucket, id) {
+			err := unRelate(tx, id, b)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, a := range relationsOf(tx, relatedBucket, id) {
+			err := unRelate(tx, a, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		history := tx.Bucket(historyBucket)
+		for _, k := range prefixKeys(history, pairKey(id, "")) {
+			err := history.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// moveAliases points the aliases of the entry at id at newId, or removes them if newId is empty.
+// Aliases are only keyed by alias, so this is a scan of the aliases table.
+func moveAliases(tx *bolt.Tx, id, newId string) error {
+	aliases := tx.Bucket(aliasesBucket)
+
+	moving := make([][]byte, 0)
+	err := aliases.ForEach(func(k, v []byte) error {
+		if string(v) == id {
+			moving = append(moving, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range moving {
+		if newId == "" {
+			err = aliases.Delete(k)
+		} else {
+			err = aliases.Put(k, []byte(newId))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *BoltIndex) SetImportance(id string, importance int) error {
+	return i.SetImportanceContext(context.Background(), id, importance)
+}
+
+func (i *BoltIndex) SetImportanceContext(ctx context.Context, id string, importance int) error {
+	_, err := i.UpdateContext(ctx, id, Patch{Importance: &importance})
+	return err
+}
+
+func (i *BoltIndex) Update(id string, p Patch) (Entry, error) {
+	return i.UpdateContext(context.Background(), id, p)
+}
+
+// UpdateContext moves an entry, along with its aliases, relations and history, in the same transaction that changes it
+func (i *BoltIndex) UpdateContext(ctx context.Context, id string, p Patch) (Entry, error) {
+	var updated Entry
+	if err := ctx.Err(); err != nil {
+		return updated, err
+	}
+
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		e, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if p.Version != nil && *p.Version != e.Version {
+			return ErrConflict
+		}
+
+		if p.empty() {
+			updated = e
+			return nil
+		}
+
+		updated = p.apply(e)
+		if updated.Id != id && tx.Bucket(entriesBucket).Get([]byte(updated.Id)) != nil {
+			return ErrAlreadyExists
+		}
+
+		err = deleteEntry(tx, e)
+		if err != nil {
+			return err
+		}
+
+		err = putEntry(tx, updated)
+		if err != nil {
+			return err
+		}
+
+		if updated.Id != id {
+			err = moveEntry(tx, id, updated.Id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return putHistory(tx, updated.Id, e)
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return updated, nil
+}
+
+// moveEntry moves the aliases, relations and history of the entry at id to newId
+func moveEntry(tx *bolt.Tx, id, newId string) error {
+	err := moveAliases(tx, id, newId)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range relationsOf(tx, relationsBucket, id) {
+		err := unRelate(tx, id, b)
+		if err != nil {
+			return err
+		}
+
+		err = relate(tx, newId, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range relationsOf(tx, relatedBucket, id) {
+		err := unRelate(tx, a, id)
+		if err != nil {
+			return err
+		}
+
+		err = relate(tx, a, newId)
+		if err != nil {
+			return err
+		}
+	}
+
+	history := tx.Bucket(historyBucket)
+	prefix := pairKey(id, "")
+	for _, k := range prefixKeys(history, prefix) {
+		v := append([]byte(nil), history.Get(k)...)
+		err := history.Put(pairKey(newId, string(k[len(prefix):])), v)
+		if err != nil {
+			return err
+		}
+
+		err = history.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *BoltIndex) History(id string) ([]Entry, error) {
+	return i.HistoryContext(context.Background(), id)
+}
+
+func (i *BoltIndex) HistoryContext(ctx context.Context, id string) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	history := make([]Entry, 0)
+
+	err := i.db.View(func(tx *bolt.Tx) error {
+		_, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+
+		c := tx.Bucket(historyBucket).Cursor()
+		prefix := pairKey(id, "")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var e Entry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			history = append(history, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
@@ -0,0 +1,104 @@
+package index
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltConformance(t *testing.T) {
+	idx, err := NewBoltIndex(filepath.Join(t.TempDir(), "index.db"), "noone")
+	if err != nil {
+		t.Fatalf("Could not open index: %v", err)
+	}
+	defer idx.Close()
+
+	testConformance(idx, t)
+}
+
+func TestBoltReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	idx, err := NewBoltIndex(path, "noone")
+	if err != nil {
+		t.Fatalf("Could not open index: %v", err)
+	}
+
+	ts := time.Date(1976, time.July, 4, 12, 0, 0, 0, time.UTC)
+	for _, e := range []Entry{{Id: "forreopening", Timestamp: ts, Gridsquare: "FM18"}, {Id: "forreopeningrelated", Timestamp: ts}} {
+		err := idx.Add(e)
+		if err != nil {
+			t.Fatalf("idx.Add returned an error: %v", err)
+		}
+	}
+
+	err = idx.Alias("reopened", "forreopening")
+	if err != nil {
+		t.Errorf("idx.Alias returned an error: %v", err)
+	}
+
+	err = idx.Relate("forreopening", "forreopeningrelated")
+	if err != nil {
+		t.Errorf("idx.Relate returned an error: %v", err)
+	}
+
+	err = idx.Close()
+	if err != nil {
+		t.Fatalf("idx.Close returned an error: %v", err)
+	}
+
+	idx, err = NewBoltIndex(path, "noone")
+	if err != nil {
+		t.Fatalf("Could not open index again: %v", err)
+	}
+	defer idx.Close()
+
+	e, err := idx.GetAlias("reopened")
+	if err != nil || e.Id != "forreopening" || !e.Timestamp.Equal(ts) {
+		t.Errorf("The alias should still be there after reopening, got %+v, %v", e, err)
+	}
+
+	relations, err := idx.Relations("forreopening")
+	if err != nil || len(relations) != 1 || relations[0] != "forreopeningrelated" {
+		t.Errorf("The relation should still be there after reopening, got %v, %v", relations, err)
+	}
+
+	entries, err := idx.QueryGridsquare("FM", Query{})
+	if err != nil || len(entries) != 1 || entries[0].Id != "forreopening" {
+		t.Errorf("The gridsquare index should still be there after reopening, got %v, %v", entries, err)
+	}
+}
+
+func TestBoltFillExact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	idx, err := NewBoltIndex(path, "noone")
+	if err != nil {
+		t.Fatalf("Could not open index: %v", err)
+	}
+
+	err = idx.Add(Entry{Id: "forfillingexact", Timestamp: time.Date(1977, time.May, 25, 0, 0, 0, 0, time.UTC), Gridsquare: "FM18"})
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	// Make the file look like one from before the exact gridsquare bucket
+	err = idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(exactBucket)
+	})
+	if err != nil {
+		t.Fatalf("Could not delete bucket: %v", err)
+	}
+	idx.Close()
+
+	idx, err = NewBoltIndex(path, "noone")
+	if err != nil {
+		t.Fatalf("Could not reopen index: %v", err)
+	}
+	defer idx.Close()
+
+	got, err := idx.QueryGridsquare("FM18", Query{ExactGridsquare: true})
+	if err != nil || len(got) != 1 || got[0].Id != "forfillingexact" {
+		t.Errorf("Reopening should have filled in the exact gridsquares, got %v, %v", got, err)
+	}
+}
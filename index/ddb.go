@@ -1,29 +1,41 @@
 package index
 
 import (
-	"fmt"
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"log"
+	"github.com/drocamor/packrat/awsretry"
+	"github.com/drocamor/packrat/store"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
 Entries: timestamp-score
 - GSI Location: username, location-score
+- GSI GroupGridsquare-Id: group-gridsquare, id
 
 Alias: alias
+- GSI Group-Id: group, id
 Relations: id, otherid
+- GSI B-A: otherid, id
+History: id, version
 
 */
 
 const (
 	entriesTable      = "Entries"
 	gridsquareIdIndex = "Group-Gridsquare"
+	exactIndex        = "GroupGridsquare-Id" // Keyed by GroupGridsquare, so the entries in exactly one gridsquare can be queried
 	aliasesTable      = "Aliases"
 	relationsTable    = "Relations"
+	aliasIdIndex      = "Group-Id" // The aliases table keyed by the Id they point to, so the aliases of an entry can be found without a filter
+	relatedIndex      = "B-A"      // The relations table turned around, so the relations to an entry can be found without a scan
+	historyTable      = "History"
 )
 
 type dynamoDBAlias struct {
@@ -37,6 +49,13 @@ type dynamoDBRelation struct {
 	A, B string
 }
 
+// dynamoDBHistory is an earlier version of an entry in the history table.
+// A is the same as in the relations table, and the Version of the entry is the range key.
+type dynamoDBHistory struct {
+	A string
+	Entry
+}
+
 type DynamoDBIndex struct {
 	ddb                *dynamodb.DynamoDB
 	group, tablePrefix string
@@ -44,6 +63,7 @@ type DynamoDBIndex struct {
 
 func NewDynamoDBIndex(sess *session.Session, group string, tablePrefix string) *DynamoDBIndex {
 	ddb := dynamodb.New(sess)
+	awsretry.Apply(ddb.Client, awsretry.DefaultPolicy)
 	return &DynamoDBIndex{
 		ddb:         ddb,
 		group:       group,
@@ -51,6 +71,12 @@ func NewDynamoDBIndex(sess *session.Session, group string, tablePrefix string) *
 	}
 }
 
+// SetRetryPolicy sets how calls to DynamoDB are retried and rate limited. Indexes start with awsretry.DefaultPolicy.
+func (i *DynamoDBIndex) SetRetryPolicy(p awsretry.Policy) *DynamoDBIndex {
+	awsretry.Apply(i.ddb.Client, p)
+	return i
+}
+
 func (i *DynamoDBIndex) entriesTable() string {
 	return i.tablePrefix + entriesTable
 }
@@ -63,10 +89,21 @@ func (i *DynamoDBIndex) relationsTable() string {
 	return i.tablePrefix + relationsTable
 }
 
+func (i *DynamoDBIndex) historyTable() string {
+	return i.tablePrefix + historyTable
+}
+
 func (i *DynamoDBIndex) Add(entry Entry) error {
+	return i.AddContext(context.Background(), entry)
+}
+
+func (i *DynamoDBIndex) AddContext(ctx context.Context, entry Entry) error {
 	entry.Group = i.group
 	entry.createIds()
-	av, err := dynamodbattribute.MarshalMap(entry)
+	if entry.Version == 0 {
+		entry.Version = 1
+	}
+	av, err := i.entryItem(entry)
 	if err != nil {
 		return err
 	}
@@ -76,25 +113,48 @@ func (i *DynamoDBIndex) Add(entry Entry) error {
 		SetConditionExpression("attribute_not_exists(Id)").
 		SetItem(av)
 
-	_, err = i.ddb.PutItem(params)
+	_, err = i.ddb.PutItemWithContext(ctx, params)
 
 	// Return a special error if the entry is already in the index
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-				return ErrAlreadyExists
-			}
-		}
+	if isConditionalCheckFailed(err) {
+		return ErrAlreadyExists
 	}
 
 	return err
 
 }
 
-func (i *DynamoDBIndex) Get(id string) (Entry, error) {
-	var entry Entry
+// entryItem returns an entry as an item in the entries table, with the GroupGridsquare that exactIndex is keyed by
+func (i *DynamoDBIndex) entryItem(e Entry) (map[string]*dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(e)
+	if err != nil {
+		return nil, err
+	}
 
-	key := map[string]*dynamodb.AttributeValue{
+	if e.Gridsquare != "" {
+		av["GroupGridsquare"] = &dynamodb.AttributeValue{S: aws.String(i.groupGridsquare(e.Gridsquare))}
+	}
+	return av, nil
+}
+
+// groupGridsquare returns the concatenation of the group, "-", and a gridsquare, or "" if there is no gridsquare
+func (i *DynamoDBIndex) groupGridsquare(gridsquare string) string {
+	if gridsquare == "" {
+		return ""
+	}
+	return i.group + "-" + gridsquare
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// entryKey returns the key of an entry in the entries table
+func (i *DynamoDBIndex) entryKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
 		"Group": {
 			S: aws.String(i.group),
 		},
@@ -102,17 +162,25 @@ func (i *DynamoDBIndex) Get(id string) (Entry, error) {
 			S: aws.String(id),
 		},
 	}
+}
+
+func (i *DynamoDBIndex) Get(id string) (Entry, error) {
+	return i.GetContext(context.Background(), id)
+}
+
+func (i *DynamoDBIndex) GetContext(ctx context.Context, id string) (Entry, error) {
+	var entry Entry
 
 	params := (&dynamodb.GetItemInput{}).
 		SetTableName(i.entriesTable()).
-		SetKey(key)
+		SetKey(i.entryKey(id))
 
-	resp, err := i.ddb.GetItem(params)
+	resp, err := i.ddb.GetItemWithContext(ctx, params)
 	if err != nil {
 		return entry, err
 	}
 	if resp.Item == nil {
-		return entry, fmt.Errorf("Entry does not exist in index")
+		return entry, ErrNotFound
 	}
 
 	err = dynamodbattribute.UnmarshalMap(resp.Item, &entry)
@@ -120,17 +188,50 @@ func (i *DynamoDBIndex) Get(id string) (Entry, error) {
 	return entry, err
 }
 func (i *DynamoDBIndex) Exists(id string) bool {
+	return i.ExistsContext(context.Background(), id)
+}
+
+func (i *DynamoDBIndex) ExistsContext(ctx context.Context, id string) bool {
 	// TODO do this more efficiently
-	_, err := i.Get(id)
+	_, err := i.GetContext(ctx, id)
 	if err != nil {
 		return false
 	}
 	return true
 }
+func (i *DynamoDBIndex) SetAddress(id, key string, a store.Address) error {
+	return i.SetAddressContext(context.Background(), id, key, a)
+}
+
+// SetAddressContext only sets the one key of Addresses, so concurrent calls for different keys don't overwrite each other
+func (i *DynamoDBIndex) SetAddressContext(ctx context.Context, id, key string, a store.Address) error {
+	address, err := dynamodbattribute.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return i.changeEntry(ctx, id, func(e Entry, names map[string]*string, values map[string]*dynamodb.AttributeValue) (sets, removes []string) {
+		// Entries without addresses need a map before a key can be set in it
+		if e.Addresses == nil {
+			values[":addresses"] = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{key: address}}
+			return []string{"Addresses = :addresses"}, nil
+		}
+
+		names["#key"] = aws.String(key)
+		values[":address"] = address
+		return []string{"Addresses.#key = :address"}, nil
+	})
+}
+
 func (i *DynamoDBIndex) Alias(alias, id string) error {
+	return i.AliasContext(context.Background(), alias, id)
+}
+
+func (i *DynamoDBIndex) AliasContext(ctx context.Context, alias, id string) error {
 	// checks that entry exists
-	if i.Exists(id) != true {
-		return fmt.Errorf("Entry does not exist in index.")
+	_, err := i.GetContext(ctx, id)
+	if err != nil {
+		return err
 	}
 
 	// Creates an alias in alias table.
@@ -151,11 +252,18 @@ func (i *DynamoDBIndex) Alias(alias, id string) error {
 		SetConditionExpression("attribute_not_exists(Alias)").
 		SetItem(av)
 
-	_, err = i.ddb.PutItem(params)
+	_, err = i.ddb.PutItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrAliasExists
+	}
 	return err
 }
 
 func (i *DynamoDBIndex) GetAlias(alias string) (Entry, error) {
+	return i.GetAliasContext(context.Background(), alias)
+}
+
+func (i *DynamoDBIndex) GetAliasContext(ctx context.Context, alias string) (Entry, error) {
 	var entry Entry
 
 	// Get on the Alias table
@@ -172,13 +280,13 @@ func (i *DynamoDBIndex) GetAlias(alias string) (Entry, error) {
 		SetTableName(i.aliasesTable()).
 		SetKey(key)
 
-	resp, err := i.ddb.GetItem(params)
+	resp, err := i.ddb.GetItemWithContext(ctx, params)
 	if err != nil {
 		return entry, err
 	}
 
 	if resp.Item == nil {
-		return entry, fmt.Errorf("Alias does not exist in index")
+		return entry, ErrAliasNotFound
 	}
 
 	var a dynamoDBAlias
@@ -189,10 +297,14 @@ func (i *DynamoDBIndex) GetAlias(alias string) (Entry, error) {
 	}
 
 	// Get on the Entries table
-	return i.Get(a.Id)
+	return i.GetContext(ctx, a.Id)
 
 }
 func (i *DynamoDBIndex) UnAlias(alias string) error {
+	return i.UnAliasContext(context.Background(), alias)
+}
+
+func (i *DynamoDBIndex) UnAliasContext(ctx context.Context, alias string) error {
 	// Deletes from alias table
 	key := map[string]*dynamodb.AttributeValue{
 		"Group": {
@@ -207,17 +319,28 @@ func (i *DynamoDBIndex) UnAlias(alias string) error {
 		SetTableName(i.aliasesTable()).
 		SetKey(key)
 
-	_, err := i.ddb.DeleteItem(params)
+	_, err := i.ddb.DeleteItemWithContext(ctx, params)
 	return err
 
 }
 func (i *DynamoDBIndex) Relate(a, b string) error {
+	return i.RelateContext(context.Background(), a, b)
+}
+
+func (i *DynamoDBIndex) RelateContext(ctx context.Context, a, b string) error {
 	// Checks that both exist
-	if i.Exists(a) != true || i.Exists(b) != true {
-		return fmt.Errorf("Both entries must exist to be related")
+	for _, id := range []string{a, b} {
+		_, err := i.GetContext(ctx, id)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Puts to relations table
+	return i.putRelation(ctx, a, b)
+}
+
+// putRelation puts to the relations table without checking that the entries exist
+func (i *DynamoDBIndex) putRelation(ctx context.Context, a, b string) error {
 	r := dynamoDBRelation{
 		A: i.group + "-" + a,
 		B: b,
@@ -232,11 +355,15 @@ func (i *DynamoDBIndex) Relate(a, b string) error {
 		SetTableName(i.relationsTable()).
 		SetItem(av)
 
-	_, err = i.ddb.PutItem(params)
+	_, err = i.ddb.PutItemWithContext(ctx, params)
 	return err
 }
 
 func (i *DynamoDBIndex) UnRelate(a, b string) error {
+	return i.UnRelateContext(context.Background(), a, b)
+}
+
+func (i *DynamoDBIndex) UnRelateContext(ctx context.Context, a, b string) error {
 	// Deletes from Relations table
 	r := dynamoDBRelation{
 		A: i.group + "-" + a,
@@ -252,11 +379,15 @@ func (i *DynamoDBIndex) UnRelate(a, b string) error {
 		SetTableName(i.relationsTable()).
 		SetKey(av)
 
-	_, err = i.ddb.DeleteItem(params)
+	_, err = i.ddb.DeleteItemWithContext(ctx, params)
 	return err
 
 }
-func (i *DynamoDBIndex) Relations(id string) []string {
+func (i *DynamoDBIndex) Relations(id string) ([]string, error) {
+	return i.RelationsContext(context.Background(), id)
+}
+
+func (i *DynamoDBIndex) RelationsContext(ctx context.Context, id string) ([]string, error) {
 	// Queries relations table
 
 	values := map[string]*dynamodb.AttributeValue{
@@ -271,14 +402,15 @@ func (i *DynamoDBIndex) Relations(id string) []string {
 		SetTableName(i.relationsTable())
 
 	results := make([]string, 0)
+	var unmarshalErr error
 
-	err := i.ddb.QueryPages(params,
+	err := i.ddb.QueryPagesWithContext(ctx, params,
 		func(page *dynamodb.QueryOutput, lastPage bool) bool {
 			var relations []dynamoDBRelation
 
-			err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &relations)
-			if err != nil {
-				log.Fatal("Error unmarshaling relations query: ", err)
+			unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &relations)
+			if unmarshalErr != nil {
+				return false
 			}
 
 			for i := 0; i < len(relations); i++ {
@@ -289,8 +421,837 @@ func (i *DynamoDBIndex) Relations(id string) []string {
 		})
 
 	if err != nil {
-		log.Fatal("Error querying relations table: ", err)
+		return nil, err
+	}
+
+	return results, unmarshalErr
+}
+
+// legacyIdSlack is how far the time at the start of an older Id can be from UTC.
+// Ids used to start with the timestamp in the item's own offset, which is between -12:00 and +14:00.
+const legacyIdSlack = 14 * time.Hour
+
+// idRange returns the bounds of the Ids that could match a query. Ids start with an RFC3339 timestamp, so the bounds are truncated to the second and the results need to be filtered again.
+// The bounds are widened by legacyIdSlack so that Ids made before they were in UTC are found too.
+func idRange(q Query) (start, end string) {
+	start = q.Start.UTC().Format(time.RFC3339)
+	if !q.Start.IsZero() {
+		start = q.Start.Add(-legacyIdSlack).UTC().Format(time.RFC3339)
+	}
+
+	// "~" sorts after anything that starts with a timestamp
+	end = "~"
+	if !q.End.IsZero() {
+		end = q.End.Add(legacyIdSlack).UTC().Format(time.RFC3339) + "~"
+	}
+
+	return
+}
+
+// queryEntries runs a query against the entries table or one of its indexes and returns the entries that match q, ordered by timestamp
+func (i *DynamoDBIndex) queryEntries(ctx context.Context, params *dynamodb.QueryInput, q Query) ([]Entry, error) {
+	filter := "Importance >= :importance"
+	params.ExpressionAttributeValues[":importance"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.Itoa(q.MinImportance)),
+	}
+
+	if q.Type != "" {
+		filter = filter + " AND #type = :type"
+		params.ExpressionAttributeNames["#type"] = aws.String("Type")
+		params.ExpressionAttributeValues[":type"] = &dynamodb.AttributeValue{
+			S: aws.String(q.Type),
+		}
+	}
+
+	if !q.IncludeDeleted {
+		filter = filter + " AND attribute_not_exists(Deleted)"
+	}
+
+	params.SetFilterExpression(filter)
+
+	results := make([]Entry, 0)
+	var unmarshalErr error
+
+	err := i.ddb.QueryPagesWithContext(ctx, params,
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var entries []Entry
+
+			unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &entries)
+			if unmarshalErr != nil {
+				return false
+			}
+
+			for _, e := range entries {
+				if q.matches(e) {
+					results = append(results, e)
+				}
+			}
+
+			return !lastPage
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	sortByTimestamp(results)
+
+	return results, nil
+}
+
+func (i *DynamoDBIndex) Query(q Query) ([]Entry, error) {
+	return i.QueryContext(context.Background(), q)
+}
+
+func (i *DynamoDBIndex) QueryContext(ctx context.Context, q Query) ([]Entry, error) {
+	start, end := idRange(q)
+
+	names := map[string]*string{
+		"#group": aws.String("Group"),
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":group": {
+			S: aws.String(i.group),
+		},
+		":start": {
+			S: aws.String(start),
+		},
+		":end": {
+			S: aws.String(end),
+		},
+	}
+
+	params := (&dynamodb.QueryInput{}).
+		SetTableName(i.entriesTable()).
+		SetExpressionAttributeNames(names).
+		SetExpressionAttributeValues(values).
+		SetKeyConditionExpression("#group = :group AND Id BETWEEN :start AND :end")
+
+	return i.queryEntries(ctx, params, q)
+}
+
+// QueryGridsquare uses the gridsquare index. Its keys are GridsquareId, so results are ordered by gridsquare before they are sorted by time.
+// With ExactGridsquare it uses exactIndex instead, so it only reads the entries in that square. Entries written before exactIndex was added aren't in it until they are updated.
+func (i *DynamoDBIndex) QueryGridsquare(gridsquare string, q Query) ([]Entry, error) {
+	return i.QueryGridsquareContext(context.Background(), gridsquare, q)
+}
+
+func (i *DynamoDBIndex) QueryGridsquareContext(ctx context.Context, gridsquare string, q Query) ([]Entry, error) {
+	if gridsquare == "" {
+		return nil, ErrNoGridsquare
+	}
+
+	if q.ExactGridsquare {
+		return i.queryExactGridsquare(ctx, gridsquare, q)
+	}
+
+	names := map[string]*string{
+		"#group": aws.String("Group"),
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":group": {
+			S: aws.String(i.group),
+		},
+		":gridsquare": {
+			S: aws.String(gridsquare),
+		},
+	}
+
+	params := (&dynamodb.QueryInput{}).
+		SetTableName(i.entriesTable()).
+		SetIndexName(gridsquareIdIndex).
+		SetExpressionAttributeNames(names).
+		SetExpressionAttributeValues(values).
+		SetKeyConditionExpression("#group = :group AND begins_with(GridsquareId, :gridsquare)")
+
+	return i.queryEntries(ctx, params, q)
+}
+
+// queryExactGridsquare queries exactIndex for the entries in exactly gridsquare. Its range key is Id, so it only reads the entries in q's time range.
+func (i *DynamoDBIndex) queryExactGridsquare(ctx context.Context, gridsquare string, q Query) ([]Entry, error) {
+	start, end := idRange(q)
+
+	names := map[string]*string{
+		"#gridsquare": aws.String("GroupGridsquare"),
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":gridsquare": {
+			S: aws.String(i.groupGridsquare(gridsquare)),
+		},
+		":start": {
+			S: aws.String(start),
+		},
+		":end": {
+			S: aws.String(end),
+		},
+	}
+
+	params := (&dynamodb.QueryInput{}).
+		SetTableName(i.entriesTable()).
+		SetIndexName(exactIndex).
+		SetExpressionAttributeNames(names).
+		SetExpressionAttributeValues(values).
+		SetKeyConditionExpression("#gridsquare = :gridsquare AND Id BETWEEN :start AND :end")
+
+	return i.queryEntries(ctx, params, q)
+}
+
+func (i *DynamoDBIndex) Delete(id string) error {
+	return i.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext keeps the time an entry was first moved to the trash if it is deleted again
+func (i *DynamoDBIndex) DeleteContext(ctx context.Context, id string) error {
+	deleted, err := dynamodbattribute.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+
+	return i.changeEntry(ctx, id, func(e Entry, names map[string]*string, values map[string]*dynamodb.AttributeValue) (sets, removes []string) {
+		values[":deleted"] = deleted
+		return []string{"Deleted = if_not_exists(Deleted, :deleted)"}, nil
+	})
+}
+
+func (i *DynamoDBIndex) Restore(id string) error {
+	return i.RestoreContext(context.Background(), id)
+}
+
+func (i *DynamoDBIndex) RestoreContext(ctx context.Context, id string) error {
+	return i.changeEntry(ctx, id, func(e Entry, names map[string]*string, values map[string]*dynamodb.AttributeValue) (sets, removes []string) {
+		return nil, []string{"Deleted"}
+	})
+}
+
+func (i *DynamoDBIndex) Purge(id string) error {
+	return i.PurgeContext(context.Background(), id)
+}
+
+// PurgeContext removes the entry last, so a purge that fails part way can be finished by purging again
+func (i *DynamoDBIndex) PurgeContext(ctx context.Context, id string) error {
+	_, err := i.GetContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = i.unAliasEntry(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = i.unRelateEntry(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	history, err := i.historyOf(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range history {
+		err := i.deleteHistory(ctx, h)
+		if err != nil {
+			return err
+		}
+	}
+
+	params := (&dynamodb.DeleteItemInput{}).
+		SetTableName(i.entriesTable()).
+		SetKey(i.entryKey(id)).
+		SetConditionExpression("attribute_exists(Id)")
+
+	_, err = i.ddb.DeleteItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// unAliasEntry removes every alias of an entry
+func (i *DynamoDBIndex) unAliasEntry(ctx context.Context, id string) error {
+	aliases, err := i.aliasesOf(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range aliases {
+		err := i.UnAliasContext(ctx, a.Alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// aliasesOf returns every alias of an entry, using aliasIdIndex. Like any secondary index it is eventually consistent, so an alias added a moment ago might not be in it yet.
+func (i *DynamoDBIndex) aliasesOf(ctx context.Context, id string) ([]dynamoDBAlias, error) {
+	names := map[string]*string{
+		"#group": aws.String("Group"),
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":group": {
+			S: aws.String(i.group),
+		},
+		":id": {
+			S: aws.String(id),
+		},
+	}
+
+	params := (&dynamodb.QueryInput{}).
+		SetTableName(i.aliasesTable()).
+		SetIndexName(aliasIdIndex).
+		SetExpressionAttributeNames(names).
+		SetExpressionAttributeValues(values).
+		SetKeyConditionExpression("#group = :group AND Id = :id")
+
+	aliases := make([]dynamoDBAlias, 0)
+	var unmarshalErr error
+
+	err := i.ddb.QueryPagesWithContext(ctx, params,
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var found []dynamoDBAlias
+
+			unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &found)
+			if unmarshalErr != nil {
+				return false
+			}
+
+			aliases = append(aliases, found...)
+			return !lastPage
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	return aliases, nil
+}
+
+// unRelateEntry removes the relations from an entry, and then the relations to it
+func (i *DynamoDBIndex) unRelateEntry(ctx context.Context, id string) error {
+	relations, err := i.RelationsContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range relations {
+		err := i.UnRelateContext(ctx, id, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	incoming, err := i.incomingRelations(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range incoming {
+		err := i.UnRelateContext(ctx, r.A[len(i.group)+1:], r.B)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// incomingRelations returns the relations to an entry from other entries in the group, using relatedIndex. It is eventually consistent, like aliasesOf.
+func (i *DynamoDBIndex) incomingRelations(ctx context.Context, id string) ([]dynamoDBRelation, error) {
+	values := map[string]*dynamodb.AttributeValue{
+		":prefix": {
+			S: aws.String(i.group + "-"),
+		},
+		":id": {
+			S: aws.String(id),
+		},
+	}
+
+	params := (&dynamodb.QueryInput{}).
+		SetTableName(i.relationsTable()).
+		SetIndexName(relatedIndex).
+		SetExpressionAttributeValues(values).
+		SetKeyConditionExpression("B = :id AND begins_with(A, :prefix)")
+
+	incoming := make([]dynamoDBRelation, 0)
+	var unmarshalErr error
+
+	err := i.ddb.QueryPagesWithContext(ctx, params,
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var found []dynamoDBRelation
+
+			unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &found)
+			if unmarshalErr != nil {
+				return false
+			}
+
+			incoming = append(incoming, found...)
+			return !lastPage
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	return incoming, nil
+}
+
+func (i *DynamoDBIndex) SetImportance(id string, importance int) error {
+	return i.SetImportanceContext(context.Background(), id, importance)
+}
+
+func (i *DynamoDBIndex) SetImportanceContext(ctx context.Context, id string, importance int) error {
+	_, err := i.UpdateContext(ctx, id, Patch{Importance: &importance})
+	return err
+}
+
+func (i *DynamoDBIndex) Update(id string, p Patch) (Entry, error) {
+	return i.UpdateContext(context.Background(), id, p)
+}
+
+// maxUpdateAttempts is how many times UpdateContext tries a patch without a Version before it gives up with ErrConflict
+const maxUpdateAttempts = 5
+
+// UpdateContext reads the entry and only writes it back if it is still at the version that was read.
+// If it changed in between, a patch without a Version is applied to the entry again, up to maxUpdateAttempts times.
+func (i *DynamoDBIndex) UpdateContext(ctx context.Context, id string, p Patch) (Entry, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		e, err := i.GetContext(ctx, id)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		if p.Version != nil && *p.Version != e.Version {
+			return Entry{}, ErrConflict
+		}
+
+		if p.empty() {
+			return e, nil
+		}
+
+		updated, err := i.updateEntry(ctx, e, p)
+		if err == ErrConflict && p.Version == nil {
+			// Read it again to see what happened to it
+			continue
+		}
+		return updated, err
+	}
+
+	return Entry{}, ErrConflict
+}
+
+// updateEntry applies a patch to an entry and keeps the entry as it was in the history, in one transaction. It returns ErrConflict if the entry is no longer at e's version.
+func (i *DynamoDBIndex) updateEntry(ctx context.Context, e Entry, p Patch) (Entry, error) {
+	updated := p.apply(e)
+	if updated.Id != e.Id {
+		err := i.moveEntry(ctx, e, updated)
+		if err != nil {
+			return Entry{}, err
+		}
+		return updated, nil
+	}
+
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+	sets := make([]string, 0)
+	removes := make([]string, 0)
+
+	// Empty strings are removed, the same way Add leaves them out
+	setString := func(name, value string) {
+		names["#"+name] = aws.String(name)
+		if value == "" {
+			removes = append(removes, "#"+name)
+			return
+		}
+		values[":"+name] = &dynamodb.AttributeValue{S: aws.String(value)}
+		sets = append(sets, "#"+name+" = :"+name)
+	}
+
+	if p.Name != nil {
+		setString("Name", updated.Name)
+	}
+
+	if p.Type != nil {
+		setString("Type", updated.Type)
+	}
+
+	if p.Gridsquare != nil {
+		setString("Gridsquare", updated.Gridsquare)
+		setString("GridsquareId", updated.GridsquareId)
+		setString("GroupGridsquare", i.groupGridsquare(updated.Gridsquare))
+	}
+
+	if p.Importance != nil {
+		names["#importance"] = aws.String("Importance")
+		values[":importance"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(updated.Importance))}
+		sets = append(sets, "#importance = :importance")
+	}
+
+	// The Timestamp can change without changing the Id if it stays in the same second, see Patch.apply
+	if p.Timestamp != nil {
+		ts, err := dynamodbattribute.Marshal(updated.Timestamp)
+		if err != nil {
+			return Entry{}, err
+		}
+		names["#timestamp"] = aws.String("Timestamp")
+		values[":timestamp"] = ts
+		sets = append(sets, "#timestamp = :timestamp")
+	}
+
+	values[":newversion"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(updated.Version))}
+	sets = append(sets, "Version = :newversion")
+
+	expr := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		expr = expr + " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	update := (&dynamodb.Update{}).
+		SetTableName(i.entriesTable()).
+		SetKey(i.entryKey(e.Id)).
+		SetConditionExpression("attribute_exists(Id) AND " + versionCondition(e.Version, values)).
+		SetUpdateExpression(expr).
+		SetExpressionAttributeNames(names).
+		SetExpressionAttributeValues(values)
+
+	historyAv, err := i.historyItem(e.Id, e)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	history := (&dynamodb.Put{}).
+		SetTableName(i.historyTable()).
+		SetItem(historyAv)
+
+	params := (&dynamodb.TransactWriteItemsInput{}).
+		SetTransactItems([]*dynamodb.TransactWriteItem{
+			{Update: update},
+			{Put: history},
+		})
+
+	_, err = i.ddb.TransactWriteItemsWithContext(ctx, params)
+	if failedCondition(err, 0) {
+		return Entry{}, ErrConflict
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return updated, nil
+}
+
+// versionCondition returns a condition expression that an entry is at version, and adds the value it uses to values
+func versionCondition(version int, values map[string]*dynamodb.AttributeValue) string {
+	values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(version))}
+
+	// Entries added before entries had versions have no Version
+	if version == 0 {
+		return "(attribute_not_exists(Version) OR Version = :version)"
+	}
+	return "Version = :version"
+}
+
+// entryChange returns the parts of an update expression that change an entry, and adds the names and values they use
+type entryChange func(e Entry, names map[string]*string, values map[string]*dynamodb.AttributeValue) (sets, removes []string)
+
+// changeEntry applies a change to an entry as its next version and keeps the entry as it was in the history, in one transaction.
+// If the entry changes while it is being changed, it is read and changed again, up to maxUpdateAttempts times.
+func (i *DynamoDBIndex) changeEntry(ctx context.Context, id string, change entryChange) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		e, err := i.GetContext(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		names := make(map[string]*string)
+		values := make(map[string]*dynamodb.AttributeValue)
+		sets, removes := change(e, names, values)
+
+		values[":newversion"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(e.Version + 1))}
+		sets = append(sets, "Version = :newversion")
+
+		expr := "SET " + strings.Join(sets, ", ")
+		if len(removes) > 0 {
+			expr = expr + " REMOVE " + strings.Join(removes, ", ")
+		}
+
+		update := (&dynamodb.Update{}).
+			SetTableName(i.entriesTable()).
+			SetKey(i.entryKey(id)).
+			SetConditionExpression("attribute_exists(Id) AND " + versionCondition(e.Version, values)).
+			SetUpdateExpression(expr).
+			SetExpressionAttributeValues(values)
+
+		// DynamoDB doesn't take an empty map of names
+		if len(names) > 0 {
+			update.SetExpressionAttributeNames(names)
+		}
+
+		historyAv, err := i.historyItem(id, e)
+		if err != nil {
+			return err
+		}
+
+		params := (&dynamodb.TransactWriteItemsInput{}).
+			SetTransactItems([]*dynamodb.TransactWriteItem{
+				{Update: update},
+				{Put: (&dynamodb.Put{}).SetTableName(i.historyTable()).SetItem(historyAv)},
+			})
+
+		_, err = i.ddb.TransactWriteItemsWithContext(ctx, params)
+		if failedCondition(err, 0) {
+			// Read it again to see what happened to it
+			continue
+		}
+		return err
+	}
+
+	return ErrConflict
+}
+
+// failedCondition tells if a transaction was cancelled because the condition on one of its items failed. Cancellation reasons are in the same order as the items.
+func failedCondition(err error, item int) bool {
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok || item >= len(canceled.CancellationReasons) {
+		return false
+	}
+	return aws.StringValue(canceled.CancellationReasons[item].Code) == "ConditionalCheckFailed"
+}
+
+// moveEntry puts an entry under its new Id and removes it from its old Id in one transaction, then moves its aliases, relations and history.
+// If moving them fails, the ones that are left are still under the old Id.
+func (i *DynamoDBIndex) moveEntry(ctx context.Context, old, e Entry) error {
+	av, err := i.entryItem(e)
+	if err != nil {
+		return err
+	}
+
+	put := (&dynamodb.Put{}).
+		SetTableName(i.entriesTable()).
+		SetConditionExpression("attribute_not_exists(Id)").
+		SetItem(av)
+
+	values := make(map[string]*dynamodb.AttributeValue)
+	del := (&dynamodb.Delete{}).
+		SetTableName(i.entriesTable()).
+		SetConditionExpression("attribute_exists(Id) AND " + versionCondition(old.Version, values)).
+		SetExpressionAttributeValues(values).
+		SetKey(i.entryKey(old.Id))
+
+	historyAv, err := i.historyItem(e.Id, old)
+	if err != nil {
+		return err
+	}
+
+	history := (&dynamodb.Put{}).
+		SetTableName(i.historyTable()).
+		SetItem(historyAv)
+
+	params := (&dynamodb.TransactWriteItemsInput{}).
+		SetTransactItems([]*dynamodb.TransactWriteItem{
+			{Put: put},
+			{Delete: del},
+			{Put: history},
+		})
+
+	_, err = i.ddb.TransactWriteItemsWithContext(ctx, params)
+	if failedCondition(err, 0) {
+		return ErrAlreadyExists
+	}
+	if failedCondition(err, 1) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	aliases, err := i.aliasesOf(ctx, old.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range aliases {
+		a.Id = e.Id
+		av, err := dynamodbattribute.MarshalMap(a)
+		if err != nil {
+			return err
+		}
+
+		params := (&dynamodb.PutItemInput{}).
+			SetTableName(i.aliasesTable()).
+			SetItem(av)
+
+		_, err = i.ddb.PutItemWithContext(ctx, params)
+		if err != nil {
+			return err
+		}
+	}
+
+	relations, err := i.RelationsContext(ctx, old.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range relations {
+		err := i.putRelation(ctx, e.Id, b)
+		if err != nil {
+			return err
+		}
+
+		err = i.UnRelateContext(ctx, old.Id, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	incoming, err := i.incomingRelations(ctx, old.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range incoming {
+		a := r.A[len(i.group)+1:]
+		err := i.putRelation(ctx, a, e.Id)
+		if err != nil {
+			return err
+		}
+
+		err = i.UnRelateContext(ctx, a, old.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	versions, err := i.historyOf(ctx, old.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range versions {
+		av, err := i.historyItem(e.Id, h.Entry)
+		if err != nil {
+			return err
+		}
+
+		params := (&dynamodb.PutItemInput{}).
+			SetTableName(i.historyTable()).
+			SetItem(av)
+
+		_, err = i.ddb.PutItemWithContext(ctx, params)
+		if err != nil {
+			return err
+		}
+
+		err = i.deleteHistory(ctx, h)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *DynamoDBIndex) History(id string) ([]Entry, error) {
+	return i.HistoryContext(context.Background(), id)
+}
+
+func (i *DynamoDBIndex) HistoryContext(ctx context.Context, id string) ([]Entry, error) {
+	_, err := i.GetContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := i.historyOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]Entry, 0, len(versions))
+	for _, h := range versions {
+		history = append(history, h.Entry)
+	}
+
+	return history, nil
+}
+
+// historyItem returns the item for an earlier version of an entry in the history of the entry at id
+func (i *DynamoDBIndex) historyItem(id string, e Entry) (map[string]*dynamodb.AttributeValue, error) {
+	return dynamodbattribute.MarshalMap(dynamoDBHistory{A: i.group + "-" + id, Entry: e})
+}
+
+// historyOf returns the history of an entry, oldest first
+func (i *DynamoDBIndex) historyOf(ctx context.Context, id string) ([]dynamoDBHistory, error) {
+	values := map[string]*dynamodb.AttributeValue{
+		":a": {
+			S: aws.String(i.group + "-" + id),
+		},
+	}
+
+	params := (&dynamodb.QueryInput{}).
+		SetTableName(i.historyTable()).
+		SetExpressionAttributeValues(values).
+		SetKeyConditionExpression("A = :a").
+		SetScanIndexForward(true)
+
+	history := make([]dynamoDBHistory, 0)
+	var unmarshalErr error
+
+	err := i.ddb.QueryPagesWithContext(ctx, params,
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var found []dynamoDBHistory
+
+			unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &found)
+			if unmarshalErr != nil {
+				return false
+			}
+
+			history = append(history, found...)
+			return !lastPage
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	return history, nil
+}
+
+func (i *DynamoDBIndex) deleteHistory(ctx context.Context, h dynamoDBHistory) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"A": {
+			S: aws.String(h.A),
+		},
+		"Version": {
+			N: aws.String(strconv.Itoa(h.Version)),
+		},
 	}
 
-	return results
+	params := (&dynamodb.DeleteItemInput{}).
+		SetTableName(i.historyTable()).
+		SetKey(key)
+
+	_, err := i.ddb.DeleteItemWithContext(ctx, params)
+	return err
 }
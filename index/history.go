@@ -0,0 +1,33 @@
+package index
+
+// Revert changes the fields of an entry that a Patch can change back to how they were at an earlier version.
+// The revert is an Update like any other, so it makes a new version and can be reverted too.
+// It returns ErrConflict if the entry changes while it is being reverted.
+func Revert(idx Index, id string, version int) (Entry, error) {
+	e, err := idx.Get(id)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	history, err := idx.History(id)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	for _, old := range history {
+		if old.Version != version {
+			continue
+		}
+
+		return idx.Update(id, Patch{
+			Name:       &old.Name,
+			Type:       &old.Type,
+			Gridsquare: &old.Gridsquare,
+			Timestamp:  &old.Timestamp,
+			Importance: &old.Importance,
+			Version:    &e.Version,
+		})
+	}
+
+	return Entry{}, ErrNoSuchVersion
+}
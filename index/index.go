@@ -1,10 +1,13 @@
 package index
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/drocamor/packrat/store"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -15,18 +18,26 @@ const (
 )
 
 var (
-	ErrAlreadyExists = errors.New("Entry already exists") // Add will return errors with this type if the entry already exists in the index
+	ErrAlreadyExists = errors.New("Entry already exists")          // Add will return errors with this type if the entry already exists in the index
+	ErrNoGridsquare  = errors.New("Gridsquare is empty")           // QueryGridsquare will return this error if it is not given a gridsquare
+	ErrNotFound      = errors.New("Entry does not exist in index") // Methods that look up an entry by id will return this error if there is no such entry
+	ErrAliasNotFound = errors.New("Alias does not exist in index") // GetAlias will return this error if there is no such alias
+	ErrAliasExists   = errors.New("Alias already exists")          // Alias will return this error if the alias already points at an entry
+	ErrConflict      = errors.New("Entry has changed")             // Update will return this error if the entry is no longer at the Version the patch expects
+	ErrNoSuchVersion = errors.New("Version is not in the history") // Revert will return this error if the entry's history doesn't have the version
 )
 
 type Entry struct {
-	Id           string    // Concatenation of the item's timestamp and some random junk
-	Name         string    `json:",omitempty"` // Name of the item. Not required.
-	Timestamp    time.Time // When this item happened
-	Importance   int       // Importance is an arbitrary number that lets you filter out things that are not important
-	Type         string    `json:",omitempty"` // What kind of thing this is, used for like thumbnailing, etc
-	Gridsquare   string    `json:",omitempty"` // maidenhead grid square
-	Group        string    // The group that this belongs to. there is probably one group per installation.
-	GridsquareId string    `json:",omitempty"` // concatenation of gridsquare and Id
+	Id           string     // Concatenation of the item's timestamp in UTC and some random junk. Older Ids have the timestamp in the item's own offset
+	Name         string     `json:",omitempty"` // Name of the item. Not required.
+	Timestamp    time.Time  // When this item happened
+	Importance   int        // Importance is an arbitrary number that lets you filter out things that are not important
+	Type         string     `json:",omitempty"` // What kind of thing this is, used for like thumbnailing, etc
+	Gridsquare   string     `json:",omitempty"` // maidenhead grid square
+	Group        string     // The group that this belongs to. there is probably one group per installation.
+	GridsquareId string     `json:",omitempty"` // concatenation of gridsquare and Id
+	Deleted      *time.Time `json:",omitempty"` // When the entry was moved to the trash, nil if it is not in the trash
+	Version      int        // Goes up by one every time the entry changes. Entries start at 1, or 0 if they were added before entries had versions
 
 	Addresses map[string]store.Address // A map of where the data is stored. Typically there is an original and an thumbnail
 }
@@ -49,12 +60,17 @@ func (e *Entry) idSuffix() string {
 	return a.Score
 }
 
+// idTimestamp returns the timestamp at the start of an Id, which is only to the second
+func idTimestamp(ts time.Time) string {
+	return ts.UTC().Format(time.RFC3339)
+}
+
 // createIds makes the Id and GridsquareId fields, but only if the Id is empty and if the gridsquare field is populated
 func (e *Entry) createIds() {
 	if e.Id == "" {
-
-		ts := e.Timestamp.Format(time.RFC3339)
-		e.Id = ts + e.idSuffix()
+		// Use UTC so that Ids sort in time order no matter where the item happened.
+		// Ids made before this started with the time in the item's own offset, so queries look a little past their bounds to find them. See idRange.
+		e.Id = idTimestamp(e.Timestamp) + e.idSuffix()
 	}
 
 	if e.Gridsquare != "" {
@@ -62,15 +78,147 @@ func (e *Entry) createIds() {
 	}
 }
 
+// Query describes a search of the index by time.
+//
+// Entries with a Timestamp between Start and End (inclusive) are returned. A zero Start or End leaves that end of the range open.
+// Entries with an Importance lower than MinImportance are filtered out. If Type is not empty, only entries of that Type are returned.
+// Entries in the trash are only returned if IncludeDeleted is true.
+// If ExactGridsquare is true, QueryGridsquare only returns entries in exactly the gridsquare it is given, and not the squares inside it. Query ignores it.
+type Query struct {
+	Start, End      time.Time
+	MinImportance   int
+	Type            string
+	IncludeDeleted  bool
+	ExactGridsquare bool
+}
+
+// matches tells if an entry satisfies the query
+func (q Query) matches(e Entry) bool {
+	if !q.Start.IsZero() && e.Timestamp.Before(q.Start) {
+		return false
+	}
+
+	if !q.End.IsZero() && e.Timestamp.After(q.End) {
+		return false
+	}
+
+	if e.Importance < q.MinImportance {
+		return false
+	}
+
+	if q.Type != "" && e.Type != q.Type {
+		return false
+	}
+
+	if e.Deleted != nil && !q.IncludeDeleted {
+		return false
+	}
+
+	return true
+}
+
+// Patch is a change to some of the fields of an entry. Fields that are nil are left alone, and setting Name, Type or Gridsquare to "" clears them.
+//
+// Ids start with the entry's Timestamp, so changing the Timestamp to another second gives the entry a new Id. Its aliases, relations and history move to the new Id.
+//
+// If Version is not nil, the patch is only applied if the entry is still at that Version. Otherwise Update returns ErrConflict, and the entry should be read again.
+// A patch that doesn't change any fields leaves the entry alone, without a new Version or a new entry in its history.
+type Patch struct {
+	Name       *string
+	Type       *string
+	Gridsquare *string
+	Timestamp  *time.Time
+	Importance *int
+	Version    *int
+}
+
+// empty tells if a patch doesn't change any fields
+func (p Patch) empty() bool {
+	return p.Name == nil && p.Type == nil && p.Gridsquare == nil && p.Timestamp == nil && p.Importance == nil
+}
+
+// apply returns the next version of an entry with a patch applied to it, with its Ids made again to match
+func (p Patch) apply(e Entry) Entry {
+	e.Version++
+
+	if p.Name != nil {
+		e.Name = *p.Name
+	}
+
+	if p.Type != nil {
+		e.Type = *p.Type
+	}
+
+	if p.Gridsquare != nil {
+		e.Gridsquare = *p.Gridsquare
+	}
+
+	if p.Importance != nil {
+		e.Importance = *p.Importance
+	}
+
+	if p.Timestamp != nil && !p.Timestamp.Equal(e.Timestamp) {
+		// An entry keeps its Id, and whatever suffix it has, if the Timestamp stays in the same second
+		old := idTimestamp(e.Timestamp)
+		if idTimestamp(*p.Timestamp) != old || !strings.HasPrefix(e.Id, old) {
+			e.Id = ""
+		}
+		e.Timestamp = *p.Timestamp
+	}
+
+	e.GridsquareId = ""
+	e.createIds()
+	return e
+}
+
+// sortByTimestamp orders entries by when they happened
+func sortByTimestamp(entries []Entry) {
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].Timestamp.Before(entries[b].Timestamp)
+	})
+}
+
 type Index interface {
-	Add(entry Entry) error                // Add an item to the index.
-	Get(id string) (Entry, error)         // Return a full entry from the index
-	Exists(id string) bool                // Tell me if something is in the index or not
-	Alias(alias, id string) error         // Adds an Alias to an entry
-	GetAlias(alias string) (Entry, error) // Gets the entry for an alias
-	UnAlias(alias string) error           // Removes an Alias to an entry
-	Relate(a, b string) error             // Relates one ID to another ID
-	UnRelate(a, b string) error           // deletes a relation
-	Relations(id string) []string         // returns the relations for an entry
-	// TODO Query
+	Add(entry Entry) error                                       // Add an item to the index.
+	Get(id string) (Entry, error)                                // Return a full entry from the index
+	Exists(id string) bool                                       // Tell me if something is in the index or not
+	Alias(alias, id string) error                                // Adds an Alias to an entry
+	GetAlias(alias string) (Entry, error)                        // Gets the entry for an alias
+	UnAlias(alias string) error                                  // Removes an Alias to an entry
+	Relate(a, b string) error                                    // Relates one ID to another ID
+	UnRelate(a, b string) error                                  // deletes a relation
+	Relations(id string) ([]string, error)                       // returns the relations for an entry
+	Query(q Query) ([]Entry, error)                              // returns the entries matching a query, ordered by timestamp
+	QueryGridsquare(gridsquare string, q Query) ([]Entry, error) // returns the entries in any gridsquare starting with gridsquare that match a query, ordered by timestamp
+	SetAddress(id, key string, a store.Address) error            // Sets one of the addresses of an entry, like when its blob moves to another store
+	Delete(id string) error                                      // Moves an entry to the trash, which hides it from queries. It can still be gotten by its id
+	Restore(id string) error                                     // Takes an entry back out of the trash
+	Purge(id string) error                                       // Removes an entry for good, along with its aliases, its history, and its relations to and from other entries
+	SetImportance(id string, importance int) error               // Changes how important an entry is
+	Update(id string, p Patch) (Entry, error)                    // Changes some of the fields of an entry, and returns the changed entry. Its Id changes if its Timestamp moves to another second
+	History(id string) ([]Entry, error)                          // Returns the versions of an entry from before each change, oldest first
+}
+
+// ContextIndex is an Index whose calls can be cancelled, or given a deadline, with a context.Context.
+// Calling a method of Index is the same as calling its Context variant with context.Background().
+type ContextIndex interface {
+	Index
+	AddContext(ctx context.Context, entry Entry) error
+	GetContext(ctx context.Context, id string) (Entry, error)
+	ExistsContext(ctx context.Context, id string) bool
+	AliasContext(ctx context.Context, alias, id string) error
+	GetAliasContext(ctx context.Context, alias string) (Entry, error)
+	UnAliasContext(ctx context.Context, alias string) error
+	RelateContext(ctx context.Context, a, b string) error
+	UnRelateContext(ctx context.Context, a, b string) error
+	RelationsContext(ctx context.Context, id string) ([]string, error)
+	QueryContext(ctx context.Context, q Query) ([]Entry, error)
+	QueryGridsquareContext(ctx context.Context, gridsquare string, q Query) ([]Entry, error)
+	SetAddressContext(ctx context.Context, id, key string, a store.Address) error
+	DeleteContext(ctx context.Context, id string) error
+	RestoreContext(ctx context.Context, id string) error
+	PurgeContext(ctx context.Context, id string) error
+	SetImportanceContext(ctx context.Context, id string, importance int) error
+	UpdateContext(ctx context.Context, id string, p Patch) (Entry, error)
+	HistoryContext(ctx context.Context, id string) ([]Entry, error)
 }
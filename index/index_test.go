@@ -1,6 +1,44 @@
 package index
 
-import "testing"
+import (
+	"context"
+	"github.com/drocamor/packrat/store"
+	"testing"
+	"time"
+)
+
+// testConformance runs every test of the Index interface against idx. Every implementation of Index should pass it, so that code tested against one behaves the same with the others.
+//
+// The tests share idx, so each one uses its own Ids, times and gridsquares. conformanceTestIds returns the Ids they use.
+func testConformance(idx ContextIndex, t *testing.T) {
+	t.Run("AddGetExists", func(t *testing.T) { testAddGetExists(idx, t) })
+	t.Run("Add", func(t *testing.T) { testAdd(idx, t) })
+	t.Run("AliasGetAliasUnAlias", func(t *testing.T) { testAliasGetAliasUnAlias(idx, t) })
+	t.Run("RelateRelationsUnrelate", func(t *testing.T) { testRelateRelationsUnrelate(idx, t) })
+	t.Run("Query", func(t *testing.T) { testQuery(idx, t) })
+	t.Run("QueryLegacyIds", func(t *testing.T) { testQueryLegacyIds(idx, t) })
+	t.Run("QueryGridsquare", func(t *testing.T) { testQueryGridsquare(idx, t) })
+	t.Run("QueryExactGridsquare", func(t *testing.T) { testQueryExactGridsquare(idx, t) })
+	t.Run("SetAddress", func(t *testing.T) { testSetAddress(idx, t) })
+	t.Run("ContextCancelled", func(t *testing.T) { testContextCancelled(idx, t) })
+	t.Run("DeleteRestorePurge", func(t *testing.T) { testDeleteRestorePurge(idx, t) })
+	t.Run("Update", func(t *testing.T) { testUpdate(idx, t) })
+	t.Run("VersionsHistory", func(t *testing.T) { testVersionsHistory(idx, t) })
+	t.Run("EmptyPatch", func(t *testing.T) { testEmptyPatch(idx, t) })
+}
+
+// conformanceTestIds returns the Ids of every entry testConformance adds, so indexes that outlive a test can be cleaned up
+func conformanceTestIds() []string {
+	ids := []string{"foo", "foraliasing", "anotheridforaliasing", "a", "b", "c", "forsetaddress", "forcontext", "forversioning", "foremptypatch"}
+	ids = append(ids, deleteTestIds()...)
+	ids = append(ids, addTestIds()...)
+	ids = append(ids, queryTestIds()...)
+	ids = append(ids, legacyTestEntry.Id)
+	ids = append(ids, gridsquareTestIds()...)
+	ids = append(ids, exactGridsquareTestIds()...)
+	ids = append(ids, updateTestIds()...)
+	return ids
+}
 
 func testAddGetExists(idx Index, t *testing.T) {
 	id := "foo"
@@ -10,8 +48,8 @@ func testAddGetExists(idx Index, t *testing.T) {
 	}
 
 	_, err := idx.Get(id)
-	if err == nil {
-		t.Errorf("idx.Get should have returned an error on a non existent entry id")
+	if err != ErrNotFound {
+		t.Errorf("idx.Get should have returned ErrNotFound on a non existent entry id, got %v", err)
 	}
 
 	e := Entry{Id: id}
@@ -33,6 +71,68 @@ func testAddGetExists(idx Index, t *testing.T) {
 
 }
 
+var addTestTimestamp = time.Date(1975, time.May, 1, 12, 0, 0, 0, time.Local)
+
+// addTestIds returns the Ids of the entries testAdd makes
+func addTestIds() []string {
+	return []string{addTestTimestamp.UTC().Format(time.RFC3339) + "foraddingscore"}
+}
+
+func testAdd(idx Index, t *testing.T) {
+	orig := store.Address{Score: "foraddingscore", Location: "file:///blobs/foraddingscore", Size: 3}
+	e := Entry{
+		Name:       "foradding",
+		Timestamp:  addTestTimestamp,
+		Importance: 3,
+		Type:       "image",
+		Gridsquare: "PM95",
+		Group:      "someoneelse",
+		Addresses:  map[string]store.Address{"orig": orig},
+	}
+
+	err := idx.Add(e)
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	// The Id is made from the UTC timestamp and the score of the original
+	id := addTestIds()[0]
+	got, err := idx.Get(id)
+	if err != nil {
+		t.Fatalf("idx.Get could not find the entry at %q: %v", id, err)
+	}
+
+	if got.Id != id || got.GridsquareId != "PM95"+id || got.Version != 1 || got.Group == "someoneelse" {
+		t.Errorf("idx.Add did not make the Ids, Version and Group, got %+v", got)
+	}
+
+	if got.Name != e.Name || !got.Timestamp.Equal(e.Timestamp) || got.Importance != e.Importance || got.Type != e.Type || got.Addresses["orig"] != orig {
+		t.Errorf("idx.Get returned %+v, expected the fields of %+v", got, e)
+	}
+
+	entries, err := idx.QueryGridsquare("PM95", Query{})
+	if err != nil || len(entries) != 1 || entries[0].Id != id {
+		t.Errorf("idx.QueryGridsquare should find the added entry, got %v, %v", entries, err)
+	}
+
+	// Adding it again doesn't overwrite it
+	e.Name = "overwritten"
+	err = idx.Add(e)
+	if err != ErrAlreadyExists {
+		t.Errorf("idx.Add should have returned ErrAlreadyExists for an entry that is already in the index, got %v", err)
+	}
+
+	err = idx.Add(Entry{Id: id})
+	if err != ErrAlreadyExists {
+		t.Errorf("idx.Add should have returned ErrAlreadyExists for an Id that is already in the index, got %v", err)
+	}
+
+	got, err = idx.Get(id)
+	if err != nil || got.Name != "foradding" {
+		t.Errorf("idx.Add should not have changed the entry, got %+v, %v", got, err)
+	}
+}
+
 func testAliasGetAliasUnAlias(idx Index, t *testing.T) {
 	id := "foraliasing"
 	alias := "bar"
@@ -44,8 +144,8 @@ func testAliasGetAliasUnAlias(idx Index, t *testing.T) {
 	}
 
 	_, err = idx.GetAlias(alias)
-	if err == nil {
-		t.Errorf("idx.GetAlias should have failed on a non existent alias")
+	if err != ErrAliasNotFound {
+		t.Errorf("idx.GetAlias should have returned ErrAliasNotFound on a non existent alias, got %v", err)
 	}
 
 	err = idx.Alias(alias, id)
@@ -60,8 +160,8 @@ func testAliasGetAliasUnAlias(idx Index, t *testing.T) {
 		t.Errorf("idx.Add failed: %v", err)
 	}
 	err = idx.Alias(alias, anotherId)
-	if err == nil {
-		t.Errorf("idx.Alias should have errored when adding an alias that already exists")
+	if err != ErrAliasExists {
+		t.Errorf("idx.Alias should have returned ErrAliasExists when adding an alias that already exists, got %v", err)
 	}
 
 	got, err := idx.GetAlias(alias)
@@ -80,8 +180,19 @@ func testAliasGetAliasUnAlias(idx Index, t *testing.T) {
 
 	// Adding an alias for a non existent item
 	err = idx.Alias(alias, "bar")
-	if err == nil {
-		t.Errorf("idx.Alias should have errored when adding an alias to a non existent item")
+	if err != ErrNotFound {
+		t.Errorf("idx.Alias should have returned ErrNotFound when adding an alias to a non existent item, got %v", err)
+	}
+
+	// The entry is checked before the alias
+	err = idx.Alias("aliasfornothing", id)
+	if err != nil {
+		t.Errorf("idx.Alias returned an error: %v", err)
+	}
+
+	err = idx.Alias("aliasfornothing", "bar")
+	if err != ErrNotFound {
+		t.Errorf("idx.Alias should have returned ErrNotFound for a taken alias and a non existent item, got %v", err)
 	}
 
 }
@@ -96,7 +207,10 @@ func testRelateRelationsUnrelate(idx Index, t *testing.T) {
 		}
 	}
 
-	relations := idx.Relations("a")
+	relations, err := idx.Relations("a")
+	if err != nil {
+		t.Errorf("idx.Relations returned an error: %v", err)
+	}
 	if len(relations) != 0 {
 		t.Errorf("foo should not have relations now, but it had %d", len(relations))
 	}
@@ -108,29 +222,733 @@ func testRelateRelationsUnrelate(idx Index, t *testing.T) {
 		}
 	}
 
-	relations = idx.Relations("a")
+	relations, err = idx.Relations("a")
+	if err != nil {
+		t.Errorf("idx.Relations returned an error: %v", err)
+	}
 
 	if len(relations) != len(ids[1:]) {
 		t.Errorf("Number of relations doesn't match expected. Expected %d, got %d", len(ids[1:]), len(relations))
 	}
 
-	err := idx.UnRelate("a", ids[2])
+	err = idx.UnRelate("a", ids[2])
 	if err != nil {
 		t.Errorf("Could not unrelate item. Error: %v", err)
 	}
 
-	relations = idx.Relations("a")
+	relations, err = idx.Relations("a")
+	if err != nil {
+		t.Errorf("idx.Relations returned an error: %v", err)
+	}
 	if len(relations) != 1 {
 		t.Errorf("Unrelating did not remove relations")
 	}
 
 	err = idx.Relate("a", "quux")
-	if err == nil {
-		t.Errorf("idx.Relate should have errored when attempting to relate something to a non existent entry")
+	if err != ErrNotFound {
+		t.Errorf("idx.Relate should have returned ErrNotFound when attempting to relate something to a non existent entry, got %v", err)
 	}
 
 	err = idx.UnRelate("a", ids[1])
 	if err != nil {
 		t.Errorf("Could not unrelate item. Error: %v", err)
 	}
+
+	relations, err = idx.Relations("quux")
+	if err != nil || len(relations) != 0 {
+		t.Errorf("idx.Relations should return no relations for a non existent entry, got %v, %v", relations, err)
+	}
+}
+
+// queryTestEntries have Ids that start with their timestamps, like the Ids made by createIds
+var queryTestEntries = []Entry{
+	{Id: "1971-01-01T00:00:00Zquery", Timestamp: time.Date(1971, 1, 1, 0, 0, 0, 0, time.UTC), Importance: 1, Type: "image"},
+	{Id: "1971-01-02T00:00:00Zquery", Timestamp: time.Date(1971, 1, 2, 0, 0, 0, 0, time.UTC), Importance: 5, Type: "image"},
+	{Id: "1971-01-03T00:00:00Zquery", Timestamp: time.Date(1971, 1, 3, 0, 0, 0, 0, time.UTC), Importance: 5, Type: "video"},
+	{Id: "1971-01-04T00:00:00Zquery", Timestamp: time.Date(1971, 1, 4, 0, 0, 0, 0, time.UTC), Importance: 10, Type: "image"},
+}
+
+func queryTestIds() []string {
+	ids := make([]string, 0)
+	for _, e := range queryTestEntries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func testQuery(idx Index, t *testing.T) {
+	// Add them out of order to make sure the results are sorted
+	for _, n := range []int{2, 0, 3, 1} {
+		err := idx.Add(queryTestEntries[n])
+		if err != nil {
+			t.Errorf("Error adding to index: %v", err)
+		}
+	}
+
+	start := time.Date(1971, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(1971, 1, 4, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"All", Query{Start: queryTestEntries[0].Timestamp, End: end}, queryTestIds()},
+		{"TimeRange", Query{Start: start, End: end.Add(-time.Second)}, []string{queryTestEntries[1].Id, queryTestEntries[2].Id}},
+		{"MinImportance", Query{Start: queryTestEntries[0].Timestamp, End: end, MinImportance: 5}, queryTestIds()[1:]},
+		{"Type", Query{Start: queryTestEntries[0].Timestamp, End: end, Type: "image"}, []string{queryTestEntries[0].Id, queryTestEntries[1].Id, queryTestEntries[3].Id}},
+		{"Empty", Query{Start: end.Add(time.Hour), End: end.Add(2 * time.Hour)}, []string{}},
+	}
+
+	for _, tt := range tests {
+		got, err := idx.Query(tt.q)
+		if err != nil {
+			t.Errorf("%s: idx.Query returned an error: %v", tt.name, err)
+			continue
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %d entries, got %d", tt.name, len(tt.want), len(got))
+			continue
+		}
+
+		for n := range got {
+			if got[n].Id != tt.want[n] {
+				t.Errorf("%s: expected entry %d to be %q, got %q", tt.name, n, tt.want[n], got[n].Id)
+			}
+		}
+	}
+}
+
+// legacyTestEntry has an Id made the way they were before Ids were in UTC
+var legacyTestEntry = Entry{
+	Id:        "1971-02-01T20:00:00-07:00legacy",
+	Timestamp: time.Date(1971, 2, 2, 3, 0, 0, 0, time.UTC),
+}
+
+func testQueryLegacyIds(idx Index, t *testing.T) {
+	err := idx.Add(legacyTestEntry)
+	if err != nil {
+		t.Fatalf("Error adding to index: %v", err)
+	}
+
+	// The Id sorts before the start of the query, but the entry is in it
+	ts := legacyTestEntry.Timestamp
+	got, err := idx.Query(Query{Start: ts.Add(-time.Hour), End: ts.Add(time.Hour)})
+	if err != nil || len(got) != 1 || got[0].Id != legacyTestEntry.Id {
+		t.Errorf("idx.Query should find an entry with an Id in its own offset, got %v, %v", got, err)
+	}
+
+	got, err = idx.Query(Query{Start: ts.Add(time.Hour), End: ts.Add(2 * time.Hour)})
+	if err != nil || len(got) != 0 {
+		t.Errorf("idx.Query should still filter by timestamp, got %v, %v", got, err)
+	}
+}
+
+var gridsquareTestEntries = []Entry{
+	{Id: "1972-01-01T00:00:00Zgridsquare", Timestamp: time.Date(1972, 1, 1, 0, 0, 0, 0, time.UTC), Gridsquare: "CN87us", Importance: 1},
+	{Id: "1972-01-02T00:00:00Zgridsquare", Timestamp: time.Date(1972, 1, 2, 0, 0, 0, 0, time.UTC), Gridsquare: "CN87ab", Importance: 5},
+	{Id: "1972-01-03T00:00:00Zgridsquare", Timestamp: time.Date(1972, 1, 3, 0, 0, 0, 0, time.UTC), Gridsquare: "CN87us", Importance: 5},
+	{Id: "1972-01-04T00:00:00Zgridsquare", Timestamp: time.Date(1972, 1, 4, 0, 0, 0, 0, time.UTC), Gridsquare: "CN88aa", Importance: 5},
+}
+
+func gridsquareTestIds() []string {
+	ids := make([]string, 0)
+	for _, e := range gridsquareTestEntries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func testQueryGridsquare(idx Index, t *testing.T) {
+	for _, e := range gridsquareTestEntries {
+		err := idx.Add(e)
+		if err != nil {
+			t.Errorf("Error adding to index: %v", err)
+		}
+	}
+
+	_, err := idx.QueryGridsquare("", Query{})
+	if err != ErrNoGridsquare {
+		t.Errorf("idx.QueryGridsquare should have returned ErrNoGridsquare for an empty gridsquare, got %v", err)
+	}
+
+	ids := gridsquareTestIds()
+	tests := []struct {
+		name       string
+		gridsquare string
+		q          Query
+		want       []string
+	}{
+		{"Exact", "CN87us", Query{}, []string{ids[0], ids[2]}},
+		{"Prefix", "CN87", Query{}, ids[:3]},
+		{"Field", "CN", Query{}, ids},
+		{"MinImportance", "CN87", Query{MinImportance: 5}, ids[1:3]},
+		{"TimeRange", "CN8", Query{Start: gridsquareTestEntries[2].Timestamp}, ids[2:]},
+		{"Nothing", "JO", Query{}, []string{}},
+		{"IntoId", "CN87us" + ids[0][:10], Query{}, []string{ids[0]}},
+	}
+
+	for _, tt := range tests {
+		got, err := idx.QueryGridsquare(tt.gridsquare, tt.q)
+		if err != nil {
+			t.Errorf("%s: idx.QueryGridsquare returned an error: %v", tt.name, err)
+			continue
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %d entries, got %d", tt.name, len(tt.want), len(got))
+			continue
+		}
+
+		for n := range got {
+			if got[n].Id != tt.want[n] {
+				t.Errorf("%s: expected entry %d to be %q, got %q", tt.name, n, tt.want[n], got[n].Id)
+			}
+		}
+	}
+}
+
+// exactGridsquareTestEntries are in a field, a square in it, and a subsquare in that. The field's GridsquareIds look like the square's, since Ids start with a year.
+var exactGridsquareTestEntries = []Entry{
+	{Id: "1978-01-01T00:00:00Zexact", Timestamp: time.Date(1978, 1, 1, 0, 0, 0, 0, time.UTC), Gridsquare: "DM"},
+	{Id: "1978-01-02T00:00:00Zexact", Timestamp: time.Date(1978, 1, 2, 0, 0, 0, 0, time.UTC), Gridsquare: "DM19"},
+	{Id: "1978-01-03T00:00:00Zexact", Timestamp: time.Date(1978, 1, 3, 0, 0, 0, 0, time.UTC), Gridsquare: "DM19ab"},
+	{Id: "1978-01-04T00:00:00Zexact", Timestamp: time.Date(1978, 1, 4, 0, 0, 0, 0, time.UTC), Gridsquare: "DM", Importance: 5},
+}
+
+func exactGridsquareTestIds() []string {
+	ids := make([]string, 0)
+	for _, e := range exactGridsquareTestEntries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func testQueryExactGridsquare(idx Index, t *testing.T) {
+	for _, e := range exactGridsquareTestEntries {
+		err := idx.Add(e)
+		if err != nil {
+			t.Errorf("Error adding to index: %v", err)
+		}
+	}
+
+	ids := exactGridsquareTestIds()
+	tests := []struct {
+		name       string
+		gridsquare string
+		q          Query
+		want       []string
+	}{
+		{"Field", "DM", Query{ExactGridsquare: true}, []string{ids[0], ids[3]}},
+		{"Square", "DM19", Query{ExactGridsquare: true}, []string{ids[1]}},
+		{"Subsquare", "DM19ab", Query{ExactGridsquare: true}, []string{ids[2]}},
+		{"MinImportance", "DM", Query{ExactGridsquare: true, MinImportance: 5}, []string{ids[3]}},
+		{"TimeRange", "DM", Query{ExactGridsquare: true, End: exactGridsquareTestEntries[2].Timestamp}, []string{ids[0]}},
+		{"Prefix", "DM1", Query{ExactGridsquare: true}, []string{}},
+		{"NotExact", "DM", Query{}, ids},
+	}
+
+	for _, tt := range tests {
+		got, err := idx.QueryGridsquare(tt.gridsquare, tt.q)
+		if err != nil {
+			t.Errorf("%s: idx.QueryGridsquare returned an error: %v", tt.name, err)
+			continue
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %d entries, got %d", tt.name, len(tt.want), len(got))
+			continue
+		}
+
+		for n := range got {
+			if got[n].Id != tt.want[n] {
+				t.Errorf("%s: expected entry %d to be %q, got %q", tt.name, n, tt.want[n], got[n].Id)
+			}
+		}
+	}
+
+	// Moving an entry to another square moves it out of the exact lookup of the old one
+	moved := "DM20"
+	_, err := idx.Update(ids[1], Patch{Gridsquare: &moved})
+	if err != nil {
+		t.Fatalf("idx.Update returned an error: %v", err)
+	}
+
+	got, err := idx.QueryGridsquare("DM19", Query{ExactGridsquare: true})
+	if err != nil || len(got) != 0 {
+		t.Errorf("DM19 should have no entries after the move, got %v, %v", got, err)
+	}
+
+	got, err = idx.QueryGridsquare(moved, Query{ExactGridsquare: true})
+	if err != nil || len(got) != 1 || got[0].Id != ids[1] {
+		t.Errorf("%s should have the moved entry, got %v, %v", moved, got, err)
+	}
+}
+
+func testSetAddress(idx Index, t *testing.T) {
+	id := "forsetaddress"
+	orig := store.Address{Score: "abc", Location: "s3://bucket/blobs/abc", Size: 3}
+	e := Entry{Id: id, Addresses: map[string]store.Address{"orig": orig}}
+
+	err := idx.Add(e)
+	if err != nil {
+		t.Errorf("Could not add entry to index: %v", err)
+	}
+
+	moved := store.Address{Score: "abc", Location: "file:///blobs/abc", Size: 3}
+	err = idx.SetAddress(id, "orig", moved)
+	if err != nil {
+		t.Errorf("idx.SetAddress returned an error: %v", err)
+	}
+
+	thumb := store.Address{Score: "def", Location: "file:///blobs/def", Size: 3}
+	err = idx.SetAddress(id, "thumb", thumb)
+	if err != nil {
+		t.Errorf("idx.SetAddress returned an error: %v", err)
+	}
+
+	got, err := idx.Get(id)
+	if err != nil {
+		t.Errorf("idx.Get returned an error: %v", err)
+	}
+
+	if got.Addresses["orig"] != moved || got.Addresses["thumb"] != thumb {
+		t.Errorf("idx.SetAddress did not update the addresses, got %+v", got.Addresses)
+	}
+
+	err = idx.SetAddress("notthere", "orig", moved)
+	if err != ErrNotFound {
+		t.Errorf("idx.SetAddress should have returned ErrNotFound for a non existent entry, got %v", err)
+	}
+}
+
+func testContextCancelled(idx ContextIndex, t *testing.T) {
+	id := "forcontext"
+	err := idx.Add(Entry{Id: id, Timestamp: time.Now()})
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = idx.AddContext(ctx, Entry{Id: "nevercontext"})
+	if err == nil {
+		t.Errorf("idx.AddContext should have returned an error with a cancelled context")
+	}
+
+	if idx.Exists("nevercontext") {
+		t.Errorf("idx.AddContext should not have added an entry with a cancelled context")
+	}
+
+	_, err = idx.GetContext(ctx, id)
+	if err == nil {
+		t.Errorf("idx.GetContext should have returned an error with a cancelled context")
+	}
+
+	if idx.ExistsContext(ctx, id) {
+		t.Errorf("idx.ExistsContext should not find anything with a cancelled context")
+	}
+
+	_, err = idx.QueryContext(ctx, Query{})
+	if err == nil {
+		t.Errorf("idx.QueryContext should have returned an error with a cancelled context")
+	}
+
+	_, err = idx.RelationsContext(ctx, id)
+	if err == nil {
+		t.Errorf("idx.RelationsContext should have returned an error with a cancelled context")
+	}
+
+	// The same calls work with a live context
+	e, err := idx.GetContext(context.Background(), id)
+	if err != nil || e.Id != id {
+		t.Errorf("idx.GetContext returned %+v, %v", e, err)
+	}
+}
+
+var deleteTestTimestamp = time.Date(1973, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// deleteTestIds returns the Ids of the entries testDeleteRestorePurge makes. They start with their timestamps so that queries find them.
+func deleteTestIds() []string {
+	return []string{
+		deleteTestTimestamp.Format(time.RFC3339) + "fordeleting",
+		deleteTestTimestamp.Add(time.Hour).Format(time.RFC3339) + "fordeletingrelated",
+	}
+}
+
+func testDeleteRestorePurge(idx Index, t *testing.T) {
+	ts := deleteTestTimestamp
+	id, other := deleteTestIds()[0], deleteTestIds()[1]
+	inTheYear := Query{Start: ts.AddDate(0, -2, 0), End: ts.AddDate(0, 9, 0)}
+
+	for _, e := range []Entry{{Id: id, Timestamp: ts}, {Id: other, Timestamp: ts.Add(time.Hour)}} {
+		err := idx.Add(e)
+		if err != nil {
+			t.Fatalf("idx.Add returned an error: %v", err)
+		}
+	}
+
+	err := idx.Alias("fordeletingalias", id)
+	if err != nil {
+		t.Errorf("idx.Alias returned an error: %v", err)
+	}
+
+	for _, pair := range [][2]string{{id, other}, {other, id}} {
+		err := idx.Relate(pair[0], pair[1])
+		if err != nil {
+			t.Errorf("idx.Relate returned an error: %v", err)
+		}
+	}
+
+	err = idx.Delete(id)
+	if err != nil {
+		t.Fatalf("idx.Delete returned an error: %v", err)
+	}
+
+	e, err := idx.Get(id)
+	if err != nil || e.Deleted == nil {
+		t.Errorf("idx.Get should return an entry in the trash with Deleted set, got %+v, %v", e, err)
+	}
+
+	entries, err := idx.Query(inTheYear)
+	if err != nil || len(entries) != 1 || entries[0].Id != other {
+		t.Errorf("idx.Query should hide entries in the trash, got %v, %v", entries, err)
+	}
+
+	q := inTheYear
+	q.IncludeDeleted = true
+	entries, err = idx.Query(q)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("idx.Query should return entries in the trash with IncludeDeleted, got %v, %v", entries, err)
+	}
+
+	err = idx.Delete("notthere")
+	if err != ErrNotFound {
+		t.Errorf("idx.Delete should have returned ErrNotFound for a non existent entry, got %v", err)
+	}
+
+	err = idx.Restore(id)
+	if err != nil {
+		t.Errorf("idx.Restore returned an error: %v", err)
+	}
+
+	entries, err = idx.Query(inTheYear)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("A restored entry should be returned by idx.Query, got %v, %v", entries, err)
+	}
+
+	err = idx.Delete(id)
+	if err != nil {
+		t.Fatalf("idx.Delete returned an error: %v", err)
+	}
+
+	// Nothing has been in the trash for an hour
+	purged, err := EmptyTrash(idx, time.Hour)
+	if err != nil || len(purged) != 0 {
+		t.Errorf("EmptyTrash should not have purged anything yet, got %v, %v", purged, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	purged, err = EmptyTrash(idx, 0)
+	if err != nil || len(purged) != 1 || purged[0].Id != id {
+		t.Errorf("EmptyTrash should have purged %q, got %v, %v", id, purged, err)
+	}
+
+	_, err = idx.Get(id)
+	if err != ErrNotFound {
+		t.Errorf("idx.Get should have returned ErrNotFound for a purged entry, got %v", err)
+	}
+
+	_, err = idx.GetAlias("fordeletingalias")
+	if err != ErrAliasNotFound {
+		t.Errorf("Purging an entry should have removed its aliases, got %v", err)
+	}
+
+	relations, err := idx.Relations(other)
+	if err != nil || len(relations) != 0 {
+		t.Errorf("Purging an entry should have removed relations to it, got %v, %v", relations, err)
+	}
+
+	err = idx.Purge(id)
+	if err != ErrNotFound {
+		t.Errorf("idx.Purge should have returned ErrNotFound for a purged entry, got %v", err)
+	}
+
+	err = idx.Purge(other)
+	if err != nil {
+		t.Errorf("idx.Purge returned an error: %v", err)
+	}
+}
+
+var (
+	updateTestTimestamp      = time.Date(1974, time.June, 1, 12, 0, 0, 0, time.UTC)
+	updateTestMovedTimestamp = time.Date(1974, time.July, 4, 12, 0, 0, 0, time.UTC)
+)
+
+// updateTestIds returns the Ids of the entries testUpdate makes, including the Id the entry moves to
+func updateTestIds() []string {
+	return []string{
+		"forupdating",
+		"forupdatingrelated",
+		updateTestMovedTimestamp.Format(time.RFC3339) + "forupdatingscore",
+	}
+}
+
+func testUpdate(idx Index, t *testing.T) {
+	id, other, movedId := updateTestIds()[0], updateTestIds()[1], updateTestIds()[2]
+	orig := store.Address{Score: "forupdatingscore", Location: "file:///blobs/forupdatingscore", Size: 3}
+
+	err := idx.Add(Entry{Id: id, Name: "before", Type: "image", Gridsquare: "JN58", Timestamp: updateTestTimestamp, Addresses: map[string]store.Address{"orig": orig}})
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	err = idx.Add(Entry{Id: other, Timestamp: updateTestTimestamp})
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	err = idx.SetImportance(id, 7)
+	if err != nil {
+		t.Errorf("idx.SetImportance returned an error: %v", err)
+	}
+
+	name, gridsquare, empty := "after", "FN31", ""
+	e, err := idx.Update(id, Patch{Name: &name, Gridsquare: &gridsquare, Type: &empty})
+	if err != nil {
+		t.Fatalf("idx.Update returned an error: %v", err)
+	}
+
+	if e.Id != id || e.Name != name || e.Type != "" || e.Importance != 7 || e.Gridsquare != gridsquare || e.GridsquareId != gridsquare+id {
+		t.Errorf("idx.Update returned %+v", e)
+	}
+
+	entries, err := idx.QueryGridsquare("FN31", Query{})
+	if err != nil || len(entries) != 1 || entries[0].Id != id {
+		t.Errorf("An entry should be found in its new gridsquare, got %v, %v", entries, err)
+	}
+
+	entries, err = idx.QueryGridsquare("JN58", Query{})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("An entry should not be found in its old gridsquare, got %v, %v", entries, err)
+	}
+
+	// Moving it in time gives it a new Id
+	err = idx.Alias("forupdatingalias", id)
+	if err != nil {
+		t.Errorf("idx.Alias returned an error: %v", err)
+	}
+
+	for _, pair := range [][2]string{{id, other}, {other, id}} {
+		err := idx.Relate(pair[0], pair[1])
+		if err != nil {
+			t.Errorf("idx.Relate returned an error: %v", err)
+		}
+	}
+
+	ts := updateTestMovedTimestamp
+	e, err = idx.Update(id, Patch{Timestamp: &ts})
+	if err != nil {
+		t.Fatalf("idx.Update returned an error: %v", err)
+	}
+
+	if e.Id != movedId || !e.Timestamp.Equal(ts) || e.Name != name || e.GridsquareId != gridsquare+movedId {
+		t.Errorf("idx.Update should have moved the entry to %q, got %+v", movedId, e)
+	}
+
+	if idx.Exists(id) {
+		t.Errorf("The entry should not be at its old Id after it moved")
+	}
+
+	e, err = idx.GetAlias("forupdatingalias")
+	if err != nil || e.Id != movedId {
+		t.Errorf("The alias should follow the entry, got %+v, %v", e, err)
+	}
+
+	relations, err := idx.Relations(movedId)
+	if err != nil || len(relations) != 1 || relations[0] != other {
+		t.Errorf("Relations from the entry should follow it, got %v, %v", relations, err)
+	}
+
+	relations, err = idx.Relations(other)
+	if err != nil || len(relations) != 1 || relations[0] != movedId {
+		t.Errorf("Relations to the entry should follow it, got %v, %v", relations, err)
+	}
+
+	entries, err = idx.Query(Query{Start: ts, End: ts})
+	if err != nil || len(entries) != 1 || entries[0].Id != movedId {
+		t.Errorf("The entry should be found at its new time, got %v, %v", entries, err)
+	}
+
+	history, err := idx.History(movedId)
+	if err != nil || len(history) != 3 {
+		t.Errorf("The history should follow the entry, got %v, %v", history, err)
+	}
+
+	// Moving it within the same second keeps its Id
+	ts = ts.Add(500 * time.Millisecond)
+	e, err = idx.Update(movedId, Patch{Timestamp: &ts})
+	if err != nil || e.Id != movedId || !e.Timestamp.Equal(ts) {
+		t.Errorf("idx.Update should have kept the Id %q, got %+v, %v", movedId, e, err)
+	}
+
+	e, err = idx.Get(movedId)
+	if err != nil || !e.Timestamp.Equal(ts) {
+		t.Errorf("The entry should have its new Timestamp, got %+v, %v", e, err)
+	}
+
+	_, err = idx.Update("notthere", Patch{Name: &name})
+	if err != ErrNotFound {
+		t.Errorf("idx.Update should have returned ErrNotFound for a non existent entry, got %v", err)
+	}
+
+	err = idx.SetImportance("notthere", 1)
+	if err != ErrNotFound {
+		t.Errorf("idx.SetImportance should have returned ErrNotFound for a non existent entry, got %v", err)
+	}
+}
+
+func testVersionsHistory(idx Index, t *testing.T) {
+	id := "forversioning"
+	err := idx.Add(Entry{Id: id, Name: "first", Importance: 5, Timestamp: time.Now()})
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	e, err := idx.Get(id)
+	if err != nil || e.Version != 1 {
+		t.Errorf("A new entry should be at version 1, got %+v, %v", e, err)
+	}
+
+	err = idx.SetImportance(id, 2)
+	if err != nil {
+		t.Errorf("idx.SetImportance returned an error: %v", err)
+	}
+
+	// A patch made from version 1 doesn't clobber the change to version 2
+	name, stale := "second", 1
+	_, err = idx.Update(id, Patch{Name: &name, Version: &stale})
+	if err != ErrConflict {
+		t.Errorf("idx.Update should have returned ErrConflict for a stale version, got %v", err)
+	}
+
+	current := 2
+	e, err = idx.Update(id, Patch{Name: &name, Version: &current})
+	if err != nil || e.Version != 3 || e.Name != name || e.Importance != 2 {
+		t.Errorf("idx.Update returned %+v, %v", e, err)
+	}
+
+	history, err := idx.History(id)
+	if err != nil || len(history) != 2 {
+		t.Fatalf("idx.History should have 2 versions, got %v, %v", history, err)
+	}
+
+	if history[0].Version != 1 || history[0].Importance != 5 || history[1].Version != 2 || history[1].Name != "first" {
+		t.Errorf("idx.History returned %+v", history)
+	}
+
+	e, err = Revert(idx, id, 1)
+	if err != nil || e.Version != 4 || e.Name != "first" || e.Importance != 5 {
+		t.Errorf("Revert returned %+v, %v", e, err)
+	}
+
+	history, err = idx.History(id)
+	if err != nil || len(history) != 3 {
+		t.Errorf("Revert should be kept in the history, got %v, %v", history, err)
+	}
+
+	_, err = Revert(idx, id, 10)
+	if err != ErrNoSuchVersion {
+		t.Errorf("Revert should have returned ErrNoSuchVersion, got %v", err)
+	}
+
+	err = idx.Delete(id)
+	if err != nil {
+		t.Errorf("idx.Delete returned an error: %v", err)
+	}
+
+	e, err = idx.Get(id)
+	if err != nil || e.Version != 5 {
+		t.Errorf("idx.Delete should make a new version, got %+v, %v", e, err)
+	}
+
+	err = idx.Restore(id)
+	if err != nil {
+		t.Errorf("idx.Restore returned an error: %v", err)
+	}
+
+	thumb := store.Address{Score: "forversioningthumb", Location: "file:///blobs/forversioningthumb", Size: 3}
+	err = idx.SetAddress(id, "thumb", thumb)
+	if err != nil {
+		t.Errorf("idx.SetAddress returned an error: %v", err)
+	}
+
+	e, err = idx.Get(id)
+	if err != nil || e.Version != 7 || e.Deleted != nil || e.Addresses["thumb"] != thumb {
+		t.Errorf("idx.Restore and idx.SetAddress should each make a new version, got %+v, %v", e, err)
+	}
+
+	// Every new version keeps the one before it in the history
+	history, err = idx.History(id)
+	if err != nil || len(history) != 6 {
+		t.Fatalf("idx.History should have 6 versions, got %v, %v", history, err)
+	}
+
+	if history[3].Version != 4 || history[3].Deleted != nil {
+		t.Errorf("The history should have the version from before idx.Delete, got %+v", history[3])
+	}
+
+	if history[4].Version != 5 || history[4].Deleted == nil {
+		t.Errorf("The history should have the version from before idx.Restore, got %+v", history[4])
+	}
+
+	if _, ok := history[5].Addresses["thumb"]; history[5].Version != 6 || ok {
+		t.Errorf("The history should have the version from before idx.SetAddress, got %+v", history[5])
+	}
+
+	_, err = idx.History("notthere")
+	if err != ErrNotFound {
+		t.Errorf("idx.History should have returned ErrNotFound for a non existent entry, got %v", err)
+	}
+}
+
+func testEmptyPatch(idx Index, t *testing.T) {
+	id := "foremptypatch"
+	err := idx.Add(Entry{Id: id, Name: "unchanged", Timestamp: time.Now()})
+	if err != nil {
+		t.Fatalf("idx.Add returned an error: %v", err)
+	}
+
+	err = idx.SetImportance(id, 3)
+	if err != nil {
+		t.Errorf("idx.SetImportance returned an error: %v", err)
+	}
+
+	before, err := idx.Get(id)
+	if err != nil {
+		t.Fatalf("idx.Get returned an error: %v", err)
+	}
+
+	history, err := idx.History(id)
+	if err != nil {
+		t.Fatalf("idx.History returned an error: %v", err)
+	}
+
+	// A patch that changes nothing leaves the entry at its Version and adds nothing to its history
+	e, err := idx.Update(id, Patch{})
+	if err != nil || e.Version != before.Version || e.Name != before.Name || e.Importance != before.Importance {
+		t.Errorf("idx.Update with an empty patch should return the entry as it was, expected %+v, got %+v, %v", before, e, err)
+	}
+
+	e, err = idx.Get(id)
+	if err != nil || e.Version != before.Version {
+		t.Errorf("idx.Update with an empty patch should not make a new version, got %+v, %v", e, err)
+	}
+
+	after, err := idx.History(id)
+	if err != nil || len(after) != len(history) {
+		t.Errorf("idx.Update with an empty patch should not grow the history, had %d versions, got %v, %v", len(history), after, err)
+	}
 }
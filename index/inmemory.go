@@ -1,14 +1,20 @@
 package index
 
 import (
-	"fmt"
+	"context"
+	"github.com/drocamor/packrat/store"
+	"strings"
 	"sync"
+	"time"
 )
 
+// InMemoryIndex is an Index that keeps everything in memory. It behaves the same as DynamoDBIndex, so it can stand in for it in tests.
 type InMemoryIndex struct {
+	group                                 string
 	entries                               map[string]Entry
 	aliases                               map[string]string
 	relations                             map[string]map[string]struct{}
+	history                               map[string][]Entry // Guarded by entryMutex
 	entryMutex, aliasMutex, relationMutex sync.Mutex
 }
 
@@ -17,31 +23,71 @@ func NewInMemoryIndex() InMemoryIndex {
 		entries:   make(map[string]Entry),
 		aliases:   make(map[string]string),
 		relations: make(map[string]map[string]struct{}),
+		history:   make(map[string][]Entry),
 	}
 }
 
+// SetGroup sets the group that entries added to the index belong to
+func (i *InMemoryIndex) SetGroup(group string) *InMemoryIndex {
+	i.group = group
+	return i
+}
+
 func (i *InMemoryIndex) Add(entry Entry) error {
+	return i.AddContext(context.Background(), entry)
+}
+
+func (i *InMemoryIndex) AddContext(ctx context.Context, entry Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entry.Group = i.group
+	entry.createIds()
+	if entry.Version == 0 {
+		entry.Version = 1
+	}
+
 	i.entryMutex.Lock()
 	defer i.entryMutex.Unlock()
 
+	if _, exists := i.entries[entry.Id]; exists {
+		return ErrAlreadyExists
+	}
 	i.entries[entry.Id] = entry
 
 	return nil
 }
 
 func (i *InMemoryIndex) Get(id string) (Entry, error) {
+	return i.GetContext(context.Background(), id)
+}
+
+func (i *InMemoryIndex) GetContext(ctx context.Context, id string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
 	i.entryMutex.Lock()
 	defer i.entryMutex.Unlock()
 
 	e, ok := i.entries[id]
 	if !ok {
-		return e, fmt.Errorf("Entry does not exist in index")
+		return e, ErrNotFound
 	}
 
 	return e, nil
 }
 
 func (i *InMemoryIndex) Exists(id string) bool {
+	return i.ExistsContext(context.Background(), id)
+}
+
+func (i *InMemoryIndex) ExistsContext(ctx context.Context, id string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
 	i.entryMutex.Lock()
 	defer i.entryMutex.Unlock()
 
@@ -49,17 +95,57 @@ func (i *InMemoryIndex) Exists(id string) bool {
 	return exists
 }
 
+func (i *InMemoryIndex) SetAddress(id, key string, a store.Address) error {
+	return i.SetAddressContext(context.Background(), id, key, a)
+}
+
+func (i *InMemoryIndex) SetAddressContext(ctx context.Context, id, key string, a store.Address) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	e, ok := i.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	// Copy the map so entries returned earlier don't change
+	addresses := make(map[string]store.Address)
+	for k, v := range e.Addresses {
+		addresses[k] = v
+	}
+	addresses[key] = a
+
+	i.history[id] = append(i.history[id], e)
+	e.Addresses = addresses
+	e.Version++
+
+	i.entries[id] = e
+	return nil
+}
+
 func (i *InMemoryIndex) Alias(alias, id string) error {
+	return i.AliasContext(context.Background(), alias, id)
+}
+
+func (i *InMemoryIndex) AliasContext(ctx context.Context, alias, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	i.aliasMutex.Lock()
 	defer i.aliasMutex.Unlock()
 
-	_, aliasExists := i.aliases[alias]
-	if aliasExists {
-		return fmt.Errorf("Alias already exists")
+	if i.ExistsContext(ctx, id) == false {
+		return ErrNotFound
 	}
 
-	if i.Exists(id) == false {
-		return fmt.Errorf("Entry does not exist in index")
+	_, aliasExists := i.aliases[alias]
+	if aliasExists {
+		return ErrAliasExists
 	}
 
 	i.aliases[alias] = id
@@ -68,17 +154,33 @@ func (i *InMemoryIndex) Alias(alias, id string) error {
 }
 
 func (i *InMemoryIndex) GetAlias(alias string) (Entry, error) {
+	return i.GetAliasContext(context.Background(), alias)
+}
+
+func (i *InMemoryIndex) GetAliasContext(ctx context.Context, alias string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
 	i.aliasMutex.Lock()
 	defer i.aliasMutex.Unlock()
 
 	id, ok := i.aliases[alias]
 	if !ok {
-		return Entry{}, fmt.Errorf("Alias does not exist in index")
+		return Entry{}, ErrAliasNotFound
 	}
-	return i.Get(id)
+	return i.GetContext(ctx, id)
 }
 
 func (i *InMemoryIndex) UnAlias(alias string) error {
+	return i.UnAliasContext(context.Background(), alias)
+}
+
+func (i *InMemoryIndex) UnAliasContext(ctx context.Context, alias string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	i.aliasMutex.Lock()
 	defer i.aliasMutex.Unlock()
 
@@ -87,12 +189,20 @@ func (i *InMemoryIndex) UnAlias(alias string) error {
 }
 
 func (i *InMemoryIndex) Relate(a, b string) error {
+	return i.RelateContext(context.Background(), a, b)
+}
+
+func (i *InMemoryIndex) RelateContext(ctx context.Context, a, b string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	i.relationMutex.Lock()
 	defer i.relationMutex.Unlock()
 
 	for _, id := range []string{a, b} {
-		if !i.Exists(id) {
-			return fmt.Errorf("%q does not exist in index", id)
+		if !i.ExistsContext(ctx, id) {
+			return ErrNotFound
 		}
 	}
 
@@ -108,6 +218,14 @@ func (i *InMemoryIndex) Relate(a, b string) error {
 }
 
 func (i *InMemoryIndex) UnRelate(a, b string) error {
+	return i.UnRelateContext(context.Background(), a, b)
+}
+
+func (i *InMemoryIndex) UnRelateContext(ctx context.Context, a, b string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	i.relationMutex.Lock()
 	defer i.relationMutex.Unlock()
 
@@ -115,20 +233,277 @@ func (i *InMemoryIndex) UnRelate(a, b string) error {
 	return nil
 }
 
-func (i *InMemoryIndex) Relations(id string) []string {
+func (i *InMemoryIndex) Relations(id string) ([]string, error) {
+	return i.RelationsContext(context.Background(), id)
+}
+
+func (i *InMemoryIndex) RelationsContext(ctx context.Context, id string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	i.relationMutex.Lock()
 	defer i.relationMutex.Unlock()
 
 	relations := make([]string, 0)
 	relationsMap, ok := i.relations[id]
 	if !ok {
-		return relations
+		return relations, nil
 	}
 
 	for id, _ := range relationsMap {
 		relations = append(relations, id)
 	}
 
-	return relations
+	return relations, nil
+
+}
+
+func (i *InMemoryIndex) Query(q Query) ([]Entry, error) {
+	return i.QueryContext(context.Background(), q)
+}
+
+func (i *InMemoryIndex) QueryContext(ctx context.Context, q Query) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	results := make([]Entry, 0)
+	for _, e := range i.entries {
+		if q.matches(e) {
+			results = append(results, e)
+		}
+	}
+
+	sortByTimestamp(results)
+
+	return results, nil
+}
+
+func (i *InMemoryIndex) QueryGridsquare(gridsquare string, q Query) ([]Entry, error) {
+	return i.QueryGridsquareContext(context.Background(), gridsquare, q)
+}
+
+func (i *InMemoryIndex) QueryGridsquareContext(ctx context.Context, gridsquare string, q Query) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if gridsquare == "" {
+		return nil, ErrNoGridsquare
+	}
+
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	inSquare := func(e Entry) bool {
+		if q.ExactGridsquare {
+			return e.Gridsquare == gridsquare
+		}
+		// Match the key DynamoDB and Bolt look entries up by, which runs on into the Id
+		return strings.HasPrefix(e.GridsquareId, gridsquare)
+	}
+
+	results := make([]Entry, 0)
+	for _, e := range i.entries {
+		if inSquare(e) && q.matches(e) {
+			results = append(results, e)
+		}
+	}
+
+	sortByTimestamp(results)
+
+	return results, nil
+}
+
+func (i *InMemoryIndex) Delete(id string) error {
+	return i.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext keeps the time an entry was first moved to the trash if it is deleted again
+func (i *InMemoryIndex) DeleteContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	e, ok := i.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	i.history[id] = append(i.history[id], e)
+	if e.Deleted == nil {
+		now := time.Now()
+		e.Deleted = &now
+	}
+	e.Version++
+	i.entries[id] = e
+
+	return nil
+}
+
+func (i *InMemoryIndex) Restore(id string) error {
+	return i.RestoreContext(context.Background(), id)
+}
+
+func (i *InMemoryIndex) RestoreContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	e, ok := i.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	i.history[id] = append(i.history[id], e)
+	e.Deleted = nil
+	e.Version++
+	i.entries[id] = e
+	return nil
+}
+
+func (i *InMemoryIndex) Purge(id string) error {
+	return i.PurgeContext(context.Background(), id)
+}
+
+func (i *InMemoryIndex) PurgeContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Take the locks in the same order as Alias and Relate
+	i.aliasMutex.Lock()
+	defer i.aliasMutex.Unlock()
+	i.relationMutex.Lock()
+	defer i.relationMutex.Unlock()
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	_, ok := i.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(i.entries, id)
+	delete(i.history, id)
+
+	for alias, aliasId := range i.aliases {
+		if aliasId == id {
+			delete(i.aliases, alias)
+		}
+	}
+
+	delete(i.relations, id)
+	for _, rel := range i.relations {
+		delete(rel, id)
+	}
+
+	return nil
+}
+
+func (i *InMemoryIndex) SetImportance(id string, importance int) error {
+	return i.SetImportanceContext(context.Background(), id, importance)
+}
+
+func (i *InMemoryIndex) SetImportanceContext(ctx context.Context, id string, importance int) error {
+	_, err := i.UpdateContext(ctx, id, Patch{Importance: &importance})
+	return err
+}
+
+func (i *InMemoryIndex) Update(id string, p Patch) (Entry, error) {
+	return i.UpdateContext(context.Background(), id, p)
+}
+
+func (i *InMemoryIndex) UpdateContext(ctx context.Context, id string, p Patch) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	// Take the locks in the same order as Purge, since the entry might move
+	i.aliasMutex.Lock()
+	defer i.aliasMutex.Unlock()
+	i.relationMutex.Lock()
+	defer i.relationMutex.Unlock()
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	e, ok := i.entries[id]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+
+	if p.Version != nil && *p.Version != e.Version {
+		return Entry{}, ErrConflict
+	}
+
+	if p.empty() {
+		return e, nil
+	}
+
+	updated := p.apply(e)
+	if updated.Id == id {
+		i.entries[id] = updated
+		i.history[id] = append(i.history[id], e)
+		return updated, nil
+	}
+
+	if _, exists := i.entries[updated.Id]; exists {
+		return Entry{}, ErrAlreadyExists
+	}
+
+	delete(i.entries, id)
+	i.entries[updated.Id] = updated
+
+	i.history[updated.Id] = append(i.history[id], e)
+	delete(i.history, id)
+
+	for alias, aliasId := range i.aliases {
+		if aliasId == id {
+			i.aliases[alias] = updated.Id
+		}
+	}
+
+	if rel, ok := i.relations[id]; ok {
+		delete(i.relations, id)
+		i.relations[updated.Id] = rel
+	}
+
+	for _, rel := range i.relations {
+		if _, ok := rel[id]; ok {
+			delete(rel, id)
+			rel[updated.Id] = struct{}{}
+		}
+	}
+
+	return updated, nil
+}
+
+func (i *InMemoryIndex) History(id string) ([]Entry, error) {
+	return i.HistoryContext(context.Background(), id)
+}
+
+func (i *InMemoryIndex) HistoryContext(ctx context.Context, id string) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	i.entryMutex.Lock()
+	defer i.entryMutex.Unlock()
+
+	if _, ok := i.entries[id]; !ok {
+		return nil, ErrNotFound
+	}
 
+	history := make([]Entry, len(i.history[id]))
+	copy(history, i.history[id])
+	return history, nil
 }
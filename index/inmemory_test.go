@@ -2,18 +2,9 @@ package index
 
 import "testing"
 
-func TestInMemAddGetExists(t *testing.T) {
+func TestInMemConformance(t *testing.T) {
 	idx := NewInMemoryIndex()
+	idx.SetGroup("noone")
 
-	testAddGetExists(&idx, t)
-}
-
-func TestInMemAliasGetAliasUnAlias(t *testing.T) {
-	idx := NewInMemoryIndex()
-	testAliasGetAliasUnAlias(&idx, t)
-}
-
-func TestInMemRelateRelationsUnrelate(t *testing.T) {
-	idx := NewInMemoryIndex()
-	testRelateRelationsUnrelate(&idx, t)
+	testConformance(&idx, t)
 }
@@ -0,0 +1,234 @@
+package index
+
+import (
+	"github.com/pd0mz/go-maidenhead"
+	"math"
+)
+
+const (
+	earthRadius         = 6371.0 // kilometres
+	kmPerDegree         = earthRadius * math.Pi / 180
+	maxCoveringSquares  = 64        // the most gridsquare queries a proximity search will make
+	maxLatitude         = 89.999999 // maidenhead locators don't work at the poles
+	longitudeFullCircle = 360.0
+)
+
+// squareSize is the size in degrees of the squares at a maidenhead precision
+type squareSize struct {
+	precision int
+	lat, long float64
+}
+
+// squareSizes goes from the most to the least precise
+var squareSizes = []squareSize{
+	{maidenhead.SubSquarePrecision, 1.0 / 24, 2.0 / 24},
+	{maidenhead.SquarePrecision, 1, 2},
+	{maidenhead.FieldPrecision, 10, 20},
+}
+
+// distanceToSquare returns the distance in kilometres from p to the nearest point of the gridsquare at locator
+func distanceToSquare(p maidenhead.Point, locator string) (float64, error) {
+	corner, err := maidenhead.ParseLocator(locator)
+	if err != nil {
+		return 0, err
+	}
+
+	center, err := maidenhead.ParseLocatorCentered(locator)
+	if err != nil {
+		return 0, err
+	}
+
+	maxLat := corner.Latitude + 2*(center.Latitude-corner.Latitude)
+	maxLong := corner.Longitude + 2*(center.Longitude-corner.Longitude)
+
+	nearest := maidenhead.NewPoint(
+		math.Max(corner.Latitude, math.Min(p.Latitude, maxLat)),
+		nearestLongitude(p.Longitude, corner.Longitude, maxLong),
+	)
+
+	if nearest == p {
+		return 0, nil
+	}
+
+	// Distance is NaN for points that are too close together for it to tell apart
+	d := p.Distance(nearest)
+	if math.IsNaN(d) {
+		return 0, nil
+	}
+	return d, nil
+}
+
+// nearestLongitude returns the longitude between min and max that is nearest to long, going either way around the world
+func nearestLongitude(long, min, max float64) float64 {
+	offset := math.Mod(long-min+2*longitudeFullCircle, longitudeFullCircle)
+	if offset <= max-min {
+		return long
+	}
+
+	east := offset - (max - min)
+	west := longitudeFullCircle - offset
+	if east < west {
+		return max
+	}
+	return min
+}
+
+// steps returns the starting edges of the squares of size step that cover min to max, with origin as the edge of the first square
+func steps(min, max, origin, step float64) []float64 {
+	results := make([]float64, 0)
+	start := origin + math.Floor((min-origin)/step)*step
+	for edge := start; edge <= max; edge += step {
+		results = append(results, edge)
+	}
+	return results
+}
+
+// coveringSquares returns the locators of the squares that cover every point within radius kilometres of p.
+// It uses the most precise squares that keep the number of locators under maxCoveringSquares.
+func coveringSquares(p maidenhead.Point, radius float64) ([]string, error) {
+	latRadius := radius / kmPerDegree
+	minLat := math.Max(p.Latitude-latRadius, -maxLatitude)
+	maxLat := math.Min(p.Latitude+latRadius, maxLatitude)
+
+	// The squares get narrower towards the poles, so use the latitude nearest to one of them
+	widest := math.Max(math.Abs(minLat), math.Abs(maxLat))
+	longRadius := longitudeFullCircle
+	if cos := math.Cos(widest * math.Pi / 180); cos > 0 {
+		longRadius = math.Min(radius/(kmPerDegree*cos), longitudeFullCircle/2)
+	}
+	minLong := p.Longitude - longRadius
+	maxLong := p.Longitude + longRadius
+
+	for n, size := range squareSizes {
+		lats := steps(minLat, maxLat, -90, size.lat)
+		longs := steps(minLong, maxLong, -180, size.long)
+
+		// Don't go around the world more than once
+		if max := int(longitudeFullCircle / size.long); len(longs) > max {
+			longs = longs[:max]
+		}
+
+		if len(lats)*len(longs) > maxCoveringSquares && n < len(squareSizes)-1 {
+			continue
+		}
+
+		seen := make(map[string]struct{})
+		locators := make([]string, 0)
+		for _, lat := range lats {
+			for _, long := range longs {
+				// Use the middle of the square so rounding doesn't put it in a neighbour
+				center := maidenhead.NewPoint(lat+size.lat/2, normalizeLongitude(long+size.long/2))
+				l, err := center.Locator(size.precision)
+				if err != nil {
+					return nil, err
+				}
+
+				if _, ok := seen[l]; !ok {
+					seen[l] = struct{}{}
+					locators = append(locators, l)
+				}
+			}
+		}
+
+		return locators, nil
+	}
+
+	return nil, nil
+}
+
+// normalizeLongitude puts a longitude back into the range -180 to 180
+func normalizeLongitude(long float64) float64 {
+	for long < -180 {
+		long += longitudeFullCircle
+	}
+	for long >= 180 {
+		long -= longitudeFullCircle
+	}
+	return long
+}
+
+// Near returns the entries in idx that are within radius kilometres of p and match q, ordered by timestamp.
+//
+// Near queries the gridsquares that cover the circle and then keeps the entries whose gridsquare comes within radius of p, so it is only as precise as the gridsquares in the index.
+// Entries with a less precise gridsquare than the covering squares are found by also querying the squares that contain them.
+func Near(idx Index, p maidenhead.Point, radius float64, q Query) ([]Entry, error) {
+	locators, err := coveringSquares(p, radius)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	results := make([]Entry, 0)
+	keep := func(e Entry) {
+		if _, ok := seen[e.Id]; ok {
+			return
+		}
+		seen[e.Id] = struct{}{}
+
+		d, err := distanceToSquare(p, e.Gridsquare)
+		if err != nil {
+			return
+		}
+
+		if d <= radius {
+			results = append(results, e)
+		}
+	}
+
+	// The covering squares include the squares inside them
+	q.ExactGridsquare = false
+	for _, l := range locators {
+		entries, err := idx.QueryGridsquare(l, q)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			keep(e)
+		}
+	}
+
+	// An entry in "CN87" doesn't start with "CN87us", so look for entries that are exactly one of the larger squares.
+	// Only those entries are read, not every entry in the squares inside them.
+	exact := q
+	exact.ExactGridsquare = true
+	for _, parent := range parentSquares(locators) {
+		entries, err := idx.QueryGridsquare(parent, exact)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			keep(e)
+		}
+	}
+
+	sortByTimestamp(results)
+
+	return results, nil
+}
+
+// parentSquares returns the locators of the larger squares that contain any of locators
+func parentSquares(locators []string) []string {
+	seen := make(map[string]struct{})
+	parents := make([]string, 0)
+	for _, l := range locators {
+		for n := 2; n < len(l); n += 2 {
+			if _, ok := seen[l[:n]]; !ok {
+				seen[l[:n]] = struct{}{}
+				parents = append(parents, l[:n])
+			}
+		}
+	}
+	return parents
+}
+
+// NearGridsquare is like Near, but searches around the middle of a gridsquare
+func NearGridsquare(idx Index, gridsquare string, radius float64, q Query) ([]Entry, error) {
+	p, err := maidenhead.ParseLocatorCentered(gridsquare)
+	if err != nil {
+		return nil, err
+	}
+
+	return Near(idx, p, radius, q)
+}
@@ -0,0 +1,158 @@
+package index
+
+import (
+	"github.com/pd0mz/go-maidenhead"
+	"testing"
+	"time"
+)
+
+func TestDistanceToSquare(t *testing.T) {
+	seattle := maidenhead.NewPoint(47.6062, -122.3321)
+	gs, err := seattle.GridSquare()
+	if err != nil {
+		t.Fatalf("Could not get gridsquare: %v", err)
+	}
+
+	for _, l := range []string{gs, "CN87", "CN"} {
+		if d, err := distanceToSquare(seattle, l); err != nil || d != 0 {
+			t.Errorf("Distance from a point to a square it is in should be 0, got %f, %v for %q", d, err, l)
+		}
+	}
+
+	// Seattle to Portland is about 233km, and the nearest edge of Portland's subsquare is a little closer
+	portland, err := maidenhead.NewPoint(45.5152, -122.6784).GridSquare()
+	if err != nil {
+		t.Fatalf("Could not get gridsquare: %v", err)
+	}
+	if d, err := distanceToSquare(seattle, portland); err != nil || d < 228 || d > 234 {
+		t.Errorf("Distance from Seattle to Portland's square should be about 231km, got %f, %v", d, err)
+	}
+
+	// The nearest edge is across the antimeridian
+	if d, err := distanceToSquare(maidenhead.NewPoint(0, 179.9), "AJ"); err != nil || d > 12 {
+		t.Errorf("Distance across the antimeridian should be about 11km, got %f, %v", d, err)
+	}
+
+	_, err = distanceToSquare(seattle, "notasquare")
+	if err == nil {
+		t.Errorf("distanceToSquare should have returned an error for an invalid locator")
+	}
+}
+
+func TestCoveringSquares(t *testing.T) {
+	p := maidenhead.NewPoint(47.6062, -122.3321)
+	gs, err := p.GridSquare()
+	if err != nil {
+		t.Fatalf("Could not get gridsquare: %v", err)
+	}
+
+	locators, err := coveringSquares(p, 1)
+	if err != nil {
+		t.Fatalf("coveringSquares returned an error: %v", err)
+	}
+
+	found := false
+	for _, l := range locators {
+		if len(l) != 6 {
+			t.Errorf("A small radius should be covered by subsquares, got %q", l)
+		}
+		if l == gs {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("The squares covering a point should include its own square %q, got %v", gs, locators)
+	}
+
+	locators, err = coveringSquares(p, 500)
+	if err != nil {
+		t.Fatalf("coveringSquares returned an error: %v", err)
+	}
+	if len(locators) > maxCoveringSquares {
+		t.Errorf("coveringSquares returned %d squares, more than the maximum of %d", len(locators), maxCoveringSquares)
+	}
+
+	// Near the antimeridian the squares should wrap around
+	locators, err = coveringSquares(maidenhead.NewPoint(0, 179.99), 10)
+	if err != nil {
+		t.Fatalf("coveringSquares returned an error near the antimeridian: %v", err)
+	}
+	wrapped := false
+	for _, l := range locators {
+		if l[0] == 'A' {
+			wrapped = true
+		}
+	}
+	if !wrapped {
+		t.Errorf("Squares covering the antimeridian should wrap around, got %v", locators)
+	}
+}
+
+func TestNear(t *testing.T) {
+	idx := NewInMemoryIndex()
+
+	points := []maidenhead.Point{
+		maidenhead.NewPoint(47.6062, -122.3321), // Seattle
+		maidenhead.NewPoint(47.6205, -122.3493), // The Space Needle
+		maidenhead.NewPoint(47.2529, -122.4443), // Tacoma
+		maidenhead.NewPoint(45.5152, -122.6784), // Portland
+	}
+
+	for n, p := range points {
+		gs, err := p.GridSquare()
+		if err != nil {
+			t.Fatalf("Could not get gridsquare: %v", err)
+		}
+		e := Entry{
+			Id:         string(rune('a' + n)),
+			Timestamp:  time.Date(1973, 1, n+1, 0, 0, 0, 0, time.UTC),
+			Gridsquare: gs,
+		}
+		err = idx.Add(e)
+		if err != nil {
+			t.Errorf("Error adding to index: %v", err)
+		}
+	}
+
+	// Only known to be somewhere around Seattle
+	err := idx.Add(Entry{Id: "e", Timestamp: time.Date(1973, 1, 5, 0, 0, 0, 0, time.UTC), Gridsquare: "CN87"})
+	if err != nil {
+		t.Errorf("Error adding to index: %v", err)
+	}
+
+	tests := []struct {
+		radius float64
+		want   []string
+	}{
+		{10, []string{"a", "b", "e"}},
+		{50, []string{"a", "b", "c", "e"}},
+		{300, []string{"a", "b", "c", "d", "e"}},
+	}
+
+	for _, tt := range tests {
+		got, err := Near(&idx, points[0], tt.radius, Query{})
+		if err != nil {
+			t.Errorf("Near returned an error: %v", err)
+			continue
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("Near %fkm: expected %d entries, got %d", tt.radius, len(tt.want), len(got))
+			continue
+		}
+
+		for n := range got {
+			if got[n].Id != tt.want[n] {
+				t.Errorf("Near %fkm: expected entry %d to be %q, got %q", tt.radius, n, tt.want[n], got[n].Id)
+			}
+		}
+	}
+
+	got, err := NearGridsquare(&idx, "CN87", 50, Query{})
+	if err != nil {
+		t.Errorf("NearGridsquare returned an error: %v", err)
+	}
+	if len(got) == 0 {
+		t.Errorf("NearGridsquare should have found entries near CN87")
+	}
+}
@@ -0,0 +1,51 @@
+package index
+
+import (
+	"time"
+)
+
+// DefaultRetention is how long entries stay in the trash before EmptyTrash purges them
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Trash returns the entries in idx that have been in the trash for longer than retention, ordered by timestamp
+func Trash(idx Index, retention time.Duration) ([]Entry, error) {
+	entries, err := idx.Query(Query{IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	results := make([]Entry, 0)
+	for _, e := range entries {
+		if e.Deleted != nil && e.Deleted.Before(cutoff) {
+			results = append(results, e)
+		}
+	}
+
+	return results, nil
+}
+
+// EmptyTrash purges the entries in idx that have been in the trash for longer than retention, and returns them.
+//
+// Their blobs stay in the stores until blob gc finds that nothing refers to them anymore.
+func EmptyTrash(idx Index, retention time.Duration) ([]Entry, error) {
+	entries, err := Trash(idx, retention)
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		err := idx.Purge(e.Id)
+		if err == ErrNotFound {
+			// Someone else purged it
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, e)
+	}
+
+	return purged, nil
+}
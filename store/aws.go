@@ -1,131 +1,318 @@
 package store
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/drocamor/packrat/awsretry"
 )
 
 const (
-	blobPrefix = "blobs/"
+	blobPrefix           = "blobs/"
+	stagingPrefix        = "staging/"
+	maxCopyObjectSize    = 5 << 30   // The biggest object S3 can copy in one request
+	copyPartSize         = 512 << 20 // Size of the parts bigger objects are copied in
+	ddbUriPrefix         = "ddb://"
+	inlineDataAttribute  = "Data"
+	aliasOfAttribute     = "AliasOf" // Alias rows have the score of the blob's row in this attribute instead of an Address
+	aliasesAttribute     = "Aliases" // Blob rows have a set of the aliases that point at them in this attribute, so they can be deleted with the blob
+	DefaultMaxInlineSize = 64 << 10  // Blobs smaller than this are stored in the index table by default
+	DefaultPartSize      = 64 << 20  // Streamed uploads are sent in parts this big, so blobs up to 640GB fit in S3's 10,000 parts
+	maxInlineSizeLimit   = 350 << 10 // DynamoDB items can't be bigger than 400KB, so leave some room for the rest of the item
 )
 
 // AWSStore is a store that puts big objects into S3 and little ones into a DynamoDB table
+//
+// Big objects are streamed to a staging key while they are hashed, then copied to blobs/<score>, so Put never needs local disk.
 type AWSStore struct {
-	ddbSvc     *dynamodb.DynamoDB
-	s3Svc      *s3.S3
-	uploader   *s3manager.Uploader
-	indexTable string // DynamoDB table to store index of objects
-	bucket     string // S3 bucket for storing big objects
-	userId     string
+	ddbSvc        *dynamodb.DynamoDB
+	s3Svc         *s3.S3
+	uploader      *s3manager.Uploader
+	indexTable    string // DynamoDB table to store index of objects
+	bucket        string // S3 bucket for storing big objects
+	maxInlineSize int64  // Blobs smaller than this are stored in the index table instead of S3
+	userId        string
 }
 
 func NewAWSStore(sess *session.Session, indexTable, bucket string) *AWSStore {
-	return &AWSStore{
-		ddbSvc:     dynamodb.New(sess),
-		s3Svc:      s3.New(sess),
-		uploader:   s3manager.NewUploader(sess),
-		indexTable: indexTable,
-		bucket:     bucket,
+	s3Svc := s3.New(sess)
+	s := &AWSStore{
+		ddbSvc:        dynamodb.New(sess),
+		s3Svc:         s3Svc,
+		uploader:      s3manager.NewUploaderWithClient(s3Svc),
+		indexTable:    indexTable,
+		bucket:        bucket,
+		maxInlineSize: DefaultMaxInlineSize,
 	}
+	return s.SetRetryPolicy(awsretry.DefaultPolicy).SetPartSize(DefaultPartSize)
+}
+
+// SetRetryPolicy sets how calls to DynamoDB and S3 are retried and rate limited. Each service gets its own rate limit. Stores start with awsretry.DefaultPolicy.
+func (s *AWSStore) SetRetryPolicy(p awsretry.Policy) *AWSStore {
+	awsretry.Apply(s.ddbSvc.Client, p)
+	awsretry.Apply(s.s3Svc.Client, p)
+	return s
+}
+
+// SetMaxInlineSize sets the size that blobs have to be smaller than to be stored in the index table. Setting it to 0 puts every blob in S3.
+// Sizes that wouldn't fit in a DynamoDB item are lowered to fit.
+func (s *AWSStore) SetMaxInlineSize(n int64) *AWSStore {
+	if n > maxInlineSizeLimit {
+		n = maxInlineSizeLimit
+	}
+	s.maxInlineSize = n
+	return s
+}
+
+// SetPartSize sets the size of the parts that streamed uploads are sent in. S3 allows 10,000 parts, so this limits how big a blob can be.
+// Each concurrent part is buffered in memory. Sizes smaller than S3 allows are raised to its minimum.
+func (s *AWSStore) SetPartSize(n int64) *AWSStore {
+	if n < s3manager.MinUploadPartSize {
+		n = s3manager.MinUploadPartSize
+	}
+	s.uploader.PartSize = n
+	return s
 }
 
 func (s *AWSStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+func (s *AWSStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
 	var a Address
-	// Create a temp file
-	tmp, err := ioutil.TempFile("", "pkrt-staging")
+
+	// Read up to the inline size to find out if this is a small blob
+	head := make([]byte, s.maxInlineSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putInline(ctx, head[:n])
+	}
 	if err != nil {
 		return a, err
 	}
-	defer os.Remove(tmp.Name())
 
-	// Tee bytes from the reader to the temp file
-	tee := io.TeeReader(r, tmp)
+	// Upload to a staging key while hashing, since the score isn't known until the whole blob has been read
+	stagingKey, a, err := s.stage(ctx, DefaultHash, io.MultiReader(bytes.NewReader(head), r))
+	defer s.deleteObject(ctx, stagingKey)
 
-	// copy the tee to the hashing func
-	h := sha256.New()
-	length, err := io.Copy(h, tee)
-	a.Size = length
 	if err != nil {
 		return a, err
 	}
 
-	score := fmt.Sprintf("%x", h.Sum(nil))
-	a.Score = score
-
 	// Use Describe to determine if the object is already in the index.
-	describedA, err := s.Describe(score)
-	log.Printf("describe err was: %v", err)
 	// If it is, return the Address
+	describedA, err := s.DescribeContext(ctx, a.Score)
 	if err == nil {
 		return describedA, err
 	}
 
-	// Rewind the tmpfile back to the beginning
-	loc, err := tmp.Seek(0, io.SeekStart)
+	key := blobPrefix + a.Score
+	a.Location = fmt.Sprintf("s3://%s/%s", s.bucket, key)
+
+	err = s.copyObject(ctx, stagingKey, key, a.Size)
 	if err != nil {
 		return a, err
 	}
 
-	log.Printf("loc is : %d", loc)
-	// Use the size to determine where to upload the data
+	err = s.putStoreIndex(ctx, a, nil)
+	if isConditionalCheckFailed(err) {
+		// Someone else put the same blob while this one was uploading
+		return s.DescribeContext(ctx, a.Score)
+	}
 
-	log.Printf("score is %q, length is %d", score, length)
-	key := blobPrefix + score
-	a.Location = fmt.Sprintf("s3://%s/%s", s.bucket, key)
+	// Return the Address
+	return a, err
+
+}
+
+// stage uploads r to a new staging key while hashing it with algorithm, and returns the key and the blob's Score and Size.
+// The caller must delete the staging key, even if there was an error.
+func (s *AWSStore) stage(ctx context.Context, algorithm string, r io.Reader) (string, Address, error) {
+	var a Address
+	stagingKey := stagingPrefix + randomKey()
+
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return stagingKey, a, err
+	}
 
-	_, err = s.uploader.Upload(&s3manager.UploadInput{
+	c := &countingWriter{}
+	_, err = s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-		Body:   tmp,
+		Key:    aws.String(stagingKey),
+		Body:   io.TeeReader(r, io.MultiWriter(h, c)),
 	})
+	if err != nil {
+		return stagingKey, a, err
+	}
+
+	a.Score = FormatScore(algorithm, h.Sum(nil))
+	a.Size = c.n
+	return stagingKey, a, nil
+}
 
+func randomKey() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
 	if err != nil {
-		return a, err
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
 	}
+	return false
+}
 
-	err = s.putStoreIndex(a)
+// copyObject copies an object within the bucket. Objects bigger than maxCopyObjectSize have to be copied in parts.
+func (s *AWSStore) copyObject(ctx context.Context, srcKey, dstKey string, size int64) error {
+	source := s.bucket + "/" + srcKey
 
-	// Return the Address
-	return a, err
+	if size <= maxCopyObjectSize {
+		params := (&s3.CopyObjectInput{}).
+			SetBucket(s.bucket).
+			SetKey(dstKey).
+			SetCopySource(source)
+
+		_, err := s.s3Svc.CopyObjectWithContext(ctx, params)
+		return err
+	}
+
+	upload, err := s.s3Svc.CreateMultipartUploadWithContext(ctx, (&s3.CreateMultipartUploadInput{}).
+		SetBucket(s.bucket).
+		SetKey(dstKey))
+	if err != nil {
+		return err
+	}
+
+	parts := make([]*s3.CompletedPart, 0)
+	for off, n := int64(0), int64(1); off < size; off, n = off+copyPartSize, n+1 {
+		last := off + copyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+
+		params := (&s3.UploadPartCopyInput{}).
+			SetBucket(s.bucket).
+			SetKey(dstKey).
+			SetUploadId(*upload.UploadId).
+			SetPartNumber(n).
+			SetCopySource(source).
+			SetCopySourceRange(fmt.Sprintf("bytes=%d-%d", off, last))
+
+		resp, err := s.s3Svc.UploadPartCopyWithContext(ctx, params)
+		if err != nil {
+			// Abort even if ctx was cancelled, so the parts don't linger
+			s.s3Svc.AbortMultipartUpload((&s3.AbortMultipartUploadInput{}).
+				SetBucket(s.bucket).
+				SetKey(dstKey).
+				SetUploadId(*upload.UploadId))
+			return err
+		}
+
+		parts = append(parts, (&s3.CompletedPart{}).
+			SetETag(*resp.CopyPartResult.ETag).
+			SetPartNumber(n))
+	}
+
+	_, err = s.s3Svc.CompleteMultipartUploadWithContext(ctx, (&s3.CompleteMultipartUploadInput{}).
+		SetBucket(s.bucket).
+		SetKey(dstKey).
+		SetUploadId(*upload.UploadId).
+		SetMultipartUpload((&s3.CompletedMultipartUpload{}).SetParts(parts)))
+	return err
+}
+
+// deleteObject deletes a staging object. If ctx is done first, the object is left under staging/ for a bucket lifecycle rule to clean up.
+func (s *AWSStore) deleteObject(ctx context.Context, key string) {
+	params := (&s3.DeleteObjectInput{}).
+		SetBucket(s.bucket).
+		SetKey(key)
 
+	_, err := s.s3Svc.DeleteObjectWithContext(ctx, params)
+	if err != nil {
+		log.Printf("Error deleting %q: %v", key, err)
+	}
 }
 
-func (s *AWSStore) putStoreIndex(a Address) error {
+// putInline stores a small blob in the index table alongside its Address
+func (s *AWSStore) putInline(ctx context.Context, data []byte) (Address, error) {
+	h := newScoreHash()
+	h.Write(data)
+	a := Address{
+		Score: FormatScore(DefaultHash, h.Sum(nil)),
+		Size:  int64(len(data)),
+	}
+
+	// If the blob is already in the store, return its Address
+	describedA, err := s.DescribeContext(ctx, a.Score)
+	if err == nil {
+		return describedA, err
+	}
+
+	a.Location = fmt.Sprintf("%s%s/%s", ddbUriPrefix, s.indexTable, a.Score)
+
+	err = s.putStoreIndex(ctx, a, data)
+	if isConditionalCheckFailed(err) {
+		return s.DescribeContext(ctx, a.Score)
+	}
+	return a, err
+}
+
+// putStoreIndex records a blob's Address in the index table. If data is not nil, it is stored in the item too.
+func (s *AWSStore) putStoreIndex(ctx context.Context, a Address, data []byte) error {
 	av, err := dynamodbattribute.MarshalMap(a)
 	if err != nil {
 		return err
 	}
 
+	if data != nil {
+		av[inlineDataAttribute] = &dynamodb.AttributeValue{B: data}
+	}
+
 	params := (&dynamodb.PutItemInput{}).
 		SetTableName(s.indexTable).
 		SetConditionExpression("attribute_not_exists(Score)").
 		SetItem(av)
 
-	_, err = s.ddbSvc.PutItem(params)
+	_, err = s.ddbSvc.PutItemWithContext(ctx, params)
 	return err
 }
 
 func (s *AWSStore) Get(score string, w io.Writer) error {
-	// Use Describe to determine the address of the blob
-	addr, err := s.Describe(score)
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *AWSStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	// Look up the address of the blob, which has the bytes too if they are stored inline
+	addr, data, err := s.getStoreIndex(ctx, score, true)
 	if err != nil {
 		return err
 	}
 
+	if data != nil {
+		_, err = w.Write(data)
+		return err
+	}
+
 	// Use GetAddress to write the bytes to w
-	return s.GetAddress(addr, w)
+	return s.GetAddressContext(ctx, addr, w)
 
 }
 
@@ -150,7 +337,45 @@ func resolveS3Uri(uri string) (bucket, key string, err error) {
 	return
 }
 
+func resolveDdbUri(uri string) (table, score string, err error) {
+	if strings.HasPrefix(uri, ddbUriPrefix) != true {
+		err = fmt.Errorf("Invalid ddb uri: %q", uri)
+		return
+	}
+
+	tableAndScore := strings.SplitN(uri[len(ddbUriPrefix):], "/", 2)
+
+	if len(tableAndScore) != 2 {
+		err = fmt.Errorf("Invalid ddb uri: %q", uri)
+		return
+	}
+
+	table = tableAndScore[0]
+	score = tableAndScore[1]
+
+	return
+}
+
 func (s *AWSStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *AWSStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	if strings.HasPrefix(a.Location, ddbUriPrefix) {
+		data, err := s.getInlineData(ctx, a)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	}
+
+	// Blobs that don't start at the beginning of their object have to be read with a range
+	if a.Offset != 0 {
+		return s.GetRangeContext(ctx, a, 0, a.Size, w)
+	}
+
 	bucket, key, err := resolveS3Uri(a.Location)
 	if err != nil {
 		return err
@@ -160,20 +385,142 @@ func (s *AWSStore) GetAddress(a Address, w io.Writer) error {
 		SetBucket(bucket).
 		SetKey(key)
 
-	resp, err := s.s3Svc.GetObject(params)
+	resp, err := s.s3Svc.GetObjectWithContext(ctx, params)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+func (s *AWSStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *AWSStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	n, err := clampRange(a, off, n)
 	if err != nil {
 		return err
 	}
 
+	// S3 can't return an empty range
+	if n == 0 {
+		return nil
+	}
+
+	if strings.HasPrefix(a.Location, ddbUriPrefix) {
+		data, err := s.getInlineData(ctx, a)
+		if err != nil {
+			return err
+		}
+
+		if off+n > int64(len(data)) {
+			return fmt.Errorf("Inline blob %q is truncated", a.Score)
+		}
+
+		_, err = w.Write(data[off : off+n])
+		return err
+	}
+
+	bucket, key, err := resolveS3Uri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	// Ranges include the last byte
+	first := a.Offset + off
+	params := (&s3.GetObjectInput{}).
+		SetBucket(bucket).
+		SetKey(key).
+		SetRange(fmt.Sprintf("bytes=%d-%d", first, first+n-1))
+
+	resp, err := s.s3Svc.GetObjectWithContext(ctx, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
 	_, err = io.Copy(w, resp.Body)
 
 	return err
 }
 
-func (s *AWSStore) Describe(score string) (Address, error) {
+// getInlineData returns a blob that is stored in an index table
+func (s *AWSStore) getInlineData(ctx context.Context, a Address) ([]byte, error) {
+	table, score, err := resolveDdbUri(a.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	key := map[string]*dynamodb.AttributeValue{
+		"Score": {
+			S: aws.String(score),
+		},
+	}
+
+	params := (&dynamodb.GetItemInput{}).
+		SetTableName(table).
+		SetKey(key).
+		SetProjectionExpression(inlineDataAttribute)
+
+	resp, err := s.ddbSvc.GetItemWithContext(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Item == nil || resp.Item[inlineDataAttribute] == nil {
+		return nil, ErrNotExist
+	}
+
+	return resp.Item[inlineDataAttribute].B, nil
+}
+
+// getStoreIndex looks up the Address of a blob in the index table, under any spelling of its score or by an alias.
+// If withData is true and the blob is stored inline, its bytes are returned too.
+func (s *AWSStore) getStoreIndex(ctx context.Context, score string, withData bool) (Address, []byte, error) {
 	a := Address{Score: score}
-	// Look up the Address from the index table and return it.
+
+	for _, spelling := range scoreSpellings(score) {
+		item, err := s.getStoreItem(ctx, spelling, withData)
+		if err != nil {
+			return a, nil, err
+		}
+		if item == nil {
+			continue
+		}
+
+		if av, ok := item[aliasOfAttribute]; ok && av.S != nil {
+			item, err = s.getStoreItem(ctx, *av.S, withData)
+			if err != nil {
+				return a, nil, err
+			}
+			if item == nil {
+				break
+			}
+		}
+
+		var data []byte
+		if av, ok := item[inlineDataAttribute]; ok {
+			// An empty blob is stored inline too, so don't mistake it for one that isn't
+			data = av.B
+			if data == nil {
+				data = []byte{}
+			}
+			delete(item, inlineDataAttribute)
+		}
+
+		err = dynamodbattribute.UnmarshalMap(item, &a)
+		return a, data, err
+	}
+
+	return a, nil, ErrNotExist
+}
+
+// getStoreItem returns the row for exactly score from the index table, or nil if there isn't one
+func (s *AWSStore) getStoreItem(ctx context.Context, score string, withData bool) (map[string]*dynamodb.AttributeValue, error) {
 	key := map[string]*dynamodb.AttributeValue{
 		"Score": {
 			S: aws.String(score),
@@ -184,16 +531,329 @@ func (s *AWSStore) Describe(score string) (Address, error) {
 		SetTableName(s.indexTable).
 		SetKey(key)
 
-	resp, err := s.ddbSvc.GetItem(params)
-	if err != nil {
-		return a, err
+	if !withData {
+		// Location, Size and Offset are reserved words
+		names := map[string]*string{
+			"#score":    aws.String("Score"),
+			"#location": aws.String("Location"),
+			"#size":     aws.String("Size"),
+			"#offset":   aws.String("Offset"),
+		}
+		params.SetProjectionExpression("#score, #location, #size, #offset, " + aliasOfAttribute).
+			SetExpressionAttributeNames(names)
 	}
 
-	if resp.Item == nil {
-		return a, fmt.Errorf("Blob does not exist in store")
+	resp, err := s.ddbSvc.GetItemWithContext(ctx, params)
+	if err != nil {
+		return nil, err
 	}
 
-	err = dynamodbattribute.UnmarshalMap(resp.Item, &a)
+	return resp.Item, nil
+}
+
+func (s *AWSStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
 
+func (s *AWSStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	a, _, err := s.getStoreIndex(ctx, score, false)
 	return a, err
 }
+
+// Delete removes a blob's row from the index table, then the rows of its aliases, and then its object from S3.
+// The row goes first, so the store never describes a blob that isn't there. A blob can't be deleted through one of its aliases.
+func (s *AWSStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *AWSStore) DeleteContext(ctx context.Context, score string) error {
+	a, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	if !SameBlob(a.Score, score) {
+		return ErrAlias
+	}
+
+	key := map[string]*dynamodb.AttributeValue{
+		"Score": {
+			S: aws.String(a.Score),
+		},
+	}
+
+	params := (&dynamodb.DeleteItemInput{}).
+		SetTableName(s.indexTable).
+		SetKey(key).
+		SetReturnValues(dynamodb.ReturnValueAllOld)
+
+	resp, err := s.ddbSvc.DeleteItemWithContext(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	if av, ok := resp.Attributes[aliasesAttribute]; ok {
+		for _, alias := range av.SS {
+			err = s.deleteAlias(ctx, *alias, a.Score)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Inline blobs went away with their row
+	if strings.HasPrefix(a.Location, ddbUriPrefix) {
+		return nil
+	}
+
+	bucket, objectKey, err := resolveS3Uri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.s3Svc.DeleteObjectWithContext(ctx, (&s3.DeleteObjectInput{}).
+		SetBucket(bucket).
+		SetKey(objectKey))
+	return err
+}
+
+// deleteAlias removes the row for alias, if it still points at the blob with score
+func (s *AWSStore) deleteAlias(ctx context.Context, alias, score string) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"Score": {
+			S: aws.String(alias),
+		},
+	}
+
+	params := (&dynamodb.DeleteItemInput{}).
+		SetTableName(s.indexTable).
+		SetKey(key).
+		SetConditionExpression(aliasOfAttribute + " = :score").
+		SetExpressionAttributeValues(map[string]*dynamodb.AttributeValue{
+			":score": {
+				S: aws.String(score),
+			},
+		})
+
+	_, err := s.ddbSvc.DeleteItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// putAlias puts the row for alias, pointing at the blob's row for score.
+// If alias already has a row, it returns ErrAliasInUse unless the row points at the same blob, or at a blob that has been deleted.
+func (s *AWSStore) putAlias(ctx context.Context, alias, score string) error {
+	item := map[string]*dynamodb.AttributeValue{
+		"Score": {
+			S: aws.String(alias),
+		},
+		aliasOfAttribute: {
+			S: aws.String(score),
+		},
+	}
+
+	params := (&dynamodb.PutItemInput{}).
+		SetTableName(s.indexTable).
+		SetConditionExpression("attribute_not_exists(Score)").
+		SetItem(item)
+
+	_, err := s.ddbSvc.PutItemWithContext(ctx, params)
+	if !isConditionalCheckFailed(err) {
+		return err
+	}
+
+	existing, err := s.getStoreItem(ctx, alias, false)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		// A blob's own row can't be an alias
+		aliasOf, ok := existing[aliasOfAttribute]
+		if !ok || aliasOf.S == nil {
+			return ErrAliasInUse
+		}
+
+		if *aliasOf.S == score {
+			return nil
+		}
+
+		target, err := s.getStoreItem(ctx, *aliasOf.S, false)
+		if err != nil {
+			return err
+		}
+		if target != nil {
+			return ErrAliasInUse
+		}
+
+		// The alias was left behind by a deleted blob, so take it, unless it has moved since
+		params.SetConditionExpression(aliasOfAttribute + " = :old").
+			SetExpressionAttributeValues(map[string]*dynamodb.AttributeValue{":old": aliasOf})
+	}
+
+	_, err = s.ddbSvc.PutItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrAliasInUse
+	}
+	return err
+}
+
+// AddAlias puts a row in the index table for alias that points at the blob's row
+func (s *AWSStore) AddAlias(score, alias string) error {
+	return s.AddAliasContext(context.Background(), score, alias)
+}
+
+func (s *AWSStore) AddAliasContext(ctx context.Context, score, alias string) error {
+	a, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	err = s.putAlias(ctx, alias, a.Score)
+	if err != nil {
+		return err
+	}
+
+	// Record the alias on the blob's row, so Delete can find it
+	update := (&dynamodb.UpdateItemInput{}).
+		SetTableName(s.indexTable).
+		SetKey(map[string]*dynamodb.AttributeValue{
+			"Score": {
+				S: aws.String(a.Score),
+			},
+		}).
+		SetUpdateExpression("ADD " + aliasesAttribute + " :alias").
+		SetConditionExpression("attribute_exists(Score)").
+		SetExpressionAttributeValues(map[string]*dynamodb.AttributeValue{
+			":alias": {
+				SS: []*string{aws.String(alias)},
+			},
+		})
+
+	_, err = s.ddbSvc.UpdateItemWithContext(ctx, update)
+	if isConditionalCheckFailed(err) {
+		// The blob was deleted while its alias was being added
+		return ErrNotExist
+	}
+	return err
+}
+
+// Replace writes a good copy of a blob over the one at Address a. Inline blobs are rewritten in their row, and others are uploaded and then copied over their object.
+func (s *AWSStore) Replace(a Address, r io.Reader) error {
+	return s.ReplaceContext(context.Background(), a, r)
+}
+
+func (s *AWSStore) ReplaceContext(ctx context.Context, a Address, r io.Reader) error {
+	algorithm, _, err := ParseScore(a.Score)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(a.Location, ddbUriPrefix) {
+		data, err := ioutil.ReadAll(io.LimitReader(r, s.maxInlineSize+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) > s.maxInlineSize {
+			return fmt.Errorf("Blob is too big to be stored inline: %q", a.Score)
+		}
+
+		score, err := HashScore(algorithm, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if !SameBlob(score, a.Score) {
+			return ErrCorrupt
+		}
+
+		// Only the bytes are rewritten, so the row keeps its aliases
+		update := (&dynamodb.UpdateItemInput{}).
+			SetTableName(s.indexTable).
+			SetKey(map[string]*dynamodb.AttributeValue{
+				"Score": {
+					S: aws.String(a.Score),
+				},
+			}).
+			SetUpdateExpression("SET " + inlineDataAttribute + " = :data, #size = :size").
+			SetConditionExpression("attribute_exists(Score)").
+			SetExpressionAttributeNames(map[string]*string{
+				"#size": aws.String("Size"),
+			}).
+			SetExpressionAttributeValues(map[string]*dynamodb.AttributeValue{
+				":data": {
+					B: data,
+				},
+				":size": {
+					N: aws.String(fmt.Sprint(len(data))),
+				},
+			})
+
+		_, err = s.ddbSvc.UpdateItemWithContext(ctx, update)
+		return err
+	}
+
+	_, key, err := resolveS3Uri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	stagingKey, staged, err := s.stage(ctx, algorithm, r)
+	defer s.deleteObject(ctx, stagingKey)
+
+	if err != nil {
+		return err
+	}
+
+	if !SameBlob(staged.Score, a.Score) {
+		return ErrCorrupt
+	}
+
+	return s.copyObject(ctx, stagingKey, key, staged.Size)
+}
+
+// Walk scans the index table a page at a time. Alias rows are skipped.
+func (s *AWSStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *AWSStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	names := map[string]*string{
+		"#score":    aws.String("Score"),
+		"#location": aws.String("Location"),
+		"#size":     aws.String("Size"),
+		"#offset":   aws.String("Offset"),
+	}
+
+	params := (&dynamodb.ScanInput{}).
+		SetTableName(s.indexTable).
+		SetProjectionExpression("#score, #location, #size, #offset").
+		SetFilterExpression("attribute_not_exists(" + aliasOfAttribute + ")").
+		SetExpressionAttributeNames(names)
+
+	var unmarshalErr error
+	err := s.ddbSvc.ScanPagesWithContext(ctx, params,
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			var addresses []Address
+
+			unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &addresses)
+			if unmarshalErr != nil {
+				return false
+			}
+
+			for _, a := range addresses {
+				if !fn(a) {
+					return false
+				}
+			}
+
+			return !lastPage
+		})
+
+	if err != nil {
+		return err
+	}
+
+	return unmarshalErr
+}
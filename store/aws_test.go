@@ -0,0 +1,40 @@
+package store
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"testing"
+)
+
+func TestAWS(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-west-2")}))
+
+	t.Run("Uploaded", func(t *testing.T) {
+		testStoreConformance(t, func(t *testing.T) ContextStore {
+			return NewAWSStore(sess, "testPRStoreIndex", "testprstore").SetMaxInlineSize(0)
+		})
+	})
+	t.Run("Inline", func(t *testing.T) {
+		testStoreConformance(t, func(t *testing.T) ContextStore {
+			return NewAWSStore(sess, "testPRStoreIndex", "testprstore")
+		})
+	})
+}
+
+func TestResolveDdbUri(t *testing.T) {
+	table, score, err := resolveDdbUri("ddb://testPRStoreIndex/abc123")
+	if err != nil {
+		t.Errorf("resolveDdbUri returned an error: %v", err)
+	}
+
+	if table != "testPRStoreIndex" || score != "abc123" {
+		t.Errorf("resolveDdbUri returned the wrong table and score: %q, %q", table, score)
+	}
+
+	for _, uri := range []string{"s3://bucket/key", "ddb://noscore"} {
+		_, _, err := resolveDdbUri(uri)
+		if err == nil {
+			t.Errorf("resolveDdbUri should have returned an error for %q", uri)
+		}
+	}
+}
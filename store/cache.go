@@ -0,0 +1,343 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheStore is a store that keeps copies of the blobs read from another store in a directory on the local filesystem.
+//
+// Blobs are content addressed, so a cached copy never goes stale. The cache is bounded by bytes, and the least recently used blobs are removed to make room.
+// Blobs bigger than the whole cache are never cached. Put, Describe, Delete and Walk go to the backing store.
+type CacheStore struct {
+	backing  Store
+	cache    *FileStore
+	maxBytes int64
+
+	mutex   sync.Mutex
+	lru     *list.List               // Front is most recently used
+	entries map[string]*list.Element // Score to element in lru
+	bytes   int64                    // Total size of the cached blobs
+	loaded  bool
+	hits    int64
+	misses  int64
+}
+
+// cacheEntry is an element of the lru
+type cacheEntry struct {
+	score string
+	size  int64
+}
+
+// CacheStats counts how well the cache is working
+type CacheStats struct {
+	Hits, Misses int64
+	Bytes        int64 // How many bytes are in the cache
+	Blobs        int   // How many blobs are in the cache
+}
+
+func NewCacheStore(backing Store, dir string, maxBytes int64) *CacheStore {
+	return &CacheStore{
+		backing:  backing,
+		cache:    NewFileStore(dir),
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// load finds the blobs already in the cache directory, using their modification times as the last time they were used. The caller must hold the mutex.
+func (s *CacheStore) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	type cached struct {
+		a    Address
+		used int64
+	}
+	found := make([]cached, 0)
+
+	err := s.cache.Walk(func(a Address) bool {
+		info, err := os.Stat(s.cache.blobPath(a.Score))
+		if err == nil {
+			found = append(found, cached{a, info.ModTime().UnixNano()})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].used > found[j].used })
+	for _, c := range found {
+		s.entries[c.a.Score] = s.lru.PushBack(&cacheEntry{c.a.Score, c.a.Size})
+		s.bytes += c.a.Size
+	}
+
+	s.loaded = true
+	s.evict()
+	return nil
+}
+
+// evict removes the least recently used blobs until the cache fits. The caller must hold the mutex.
+func (s *CacheStore) evict() {
+	for s.bytes > s.maxBytes && s.lru.Len() > 0 {
+		e := s.lru.Remove(s.lru.Back()).(*cacheEntry)
+		delete(s.entries, e.score)
+		s.bytes -= e.size
+
+		s.cache.Delete(e.score)
+	}
+}
+
+// lookup tells if a blob is cached, and marks it as used
+func (s *CacheStore) lookup(score string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return false, err
+	}
+
+	for _, spelling := range scoreSpellings(score) {
+		if e, ok := s.entries[spelling]; ok {
+			s.lru.MoveToFront(e)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// count records whether a read was served by the cache
+func (s *CacheStore) count(hit bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if hit {
+		s.hits++
+	} else {
+		s.misses++
+	}
+}
+
+// forget removes a blob from the cache under every spelling of its score. The caller must hold the mutex.
+func (s *CacheStore) forget(score string) {
+	for _, spelling := range scoreSpellings(score) {
+		if e, ok := s.entries[spelling]; ok {
+			s.lru.Remove(e)
+			delete(s.entries, spelling)
+			s.bytes -= e.Value.(*cacheEntry).size
+		}
+		s.cache.Delete(spelling)
+	}
+}
+
+// add records a blob that was put in the cache directory
+func (s *CacheStore) add(a Address) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if e, ok := s.entries[a.Score]; ok {
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	s.entries[a.Score] = s.lru.PushFront(&cacheEntry{a.Score, a.Size})
+	s.bytes += a.Size
+	s.evict()
+}
+
+// fill copies a blob from the backing store into the cache
+func (s *CacheStore) fill(ctx context.Context, a Address) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(withContext(s.backing).GetAddressContext(ctx, a, pw))
+	}()
+
+	cached, err := s.cache.PutContext(ctx, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+
+	if !SameBlob(cached.Score, a.Score) {
+		s.cache.Delete(cached.Score)
+		return ErrCorrupt
+	}
+
+	s.add(cached)
+	return nil
+}
+
+// cachedAddress returns the Address of a blob in the cache, copying it there first if it isn't cached yet.
+// ok is false if the blob can't be cached, and should be read from the backing store.
+// It only counts a hit if the blob was already in the cache and is still there.
+func (s *CacheStore) cachedAddress(ctx context.Context, a Address) (Address, bool) {
+	if a.Size > s.maxBytes {
+		s.count(false)
+		return a, false
+	}
+
+	hit, err := s.lookup(a.Score)
+	if err != nil {
+		s.count(false)
+		return a, false
+	}
+
+	cached, ok := s.cached(ctx, a, hit)
+	s.count(hit && ok)
+	return cached, ok
+}
+
+// cached is like cachedAddress, for a blob that has already been looked up
+func (s *CacheStore) cached(ctx context.Context, a Address, hit bool) (Address, bool) {
+	if !hit {
+		err := s.fill(ctx, a)
+		if err != nil {
+			return a, false
+		}
+	}
+
+	// It could have been evicted already
+	cached, err := s.cache.Describe(a.Score)
+	if err != nil {
+		return a, false
+	}
+
+	// Touch it so the order survives a restart
+	now := time.Now()
+	os.Chtimes(s.cache.blobPath(a.Score), now, now)
+
+	return cached, true
+}
+
+func (s *CacheStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+func (s *CacheStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	return withContext(s.backing).PutContext(ctx, r)
+}
+
+// Get doesn't need the backing store at all when the blob is cached
+func (s *CacheStore) Get(score string, w io.Writer) error {
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *CacheStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	hit, err := s.lookup(score)
+	if err == nil && hit {
+		cached, err := s.cache.Describe(score)
+		if err == nil {
+			s.count(true)
+			return s.cache.GetAddressContext(ctx, cached, w)
+		}
+
+		// Something else removed it from the cache directory
+		s.mutex.Lock()
+		s.forget(score)
+		s.mutex.Unlock()
+	}
+	s.count(false)
+
+	addr, err := withContext(s.backing).DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	if addr.Size <= s.maxBytes {
+		if cached, ok := s.cached(ctx, addr, false); ok {
+			return s.cache.GetAddressContext(ctx, cached, w)
+		}
+	}
+
+	return withContext(s.backing).GetAddressContext(ctx, addr, w)
+}
+
+func (s *CacheStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *CacheStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	cached, ok := s.cachedAddress(ctx, a)
+	if !ok {
+		return withContext(s.backing).GetAddressContext(ctx, a, w)
+	}
+
+	return s.cache.GetAddressContext(ctx, cached, w)
+}
+
+func (s *CacheStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *CacheStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	cached, ok := s.cachedAddress(ctx, a)
+	if !ok {
+		return withContext(s.backing).GetRangeContext(ctx, a, off, n, w)
+	}
+
+	return s.cache.GetRangeContext(ctx, cached, off, n, w)
+}
+
+func (s *CacheStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
+
+func (s *CacheStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	return withContext(s.backing).DescribeContext(ctx, score)
+}
+
+// Delete removes the blob from the cache too, under any spelling of its score, even if the cache hasn't been used yet
+func (s *CacheStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *CacheStore) DeleteContext(ctx context.Context, score string) error {
+	s.mutex.Lock()
+	err := s.load()
+	if err == nil {
+		s.forget(score)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return withContext(s.backing).DeleteContext(ctx, score)
+}
+
+func (s *CacheStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *CacheStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	return withContext(s.backing).WalkContext(ctx, fn)
+}
+
+// Stats returns the cache's hit and miss counters and how full it is
+func (s *CacheStore) Stats() CacheStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return CacheStats{
+		Hits:   s.hits,
+		Misses: s.misses,
+		Bytes:  s.bytes,
+		Blobs:  s.lru.Len(),
+	}
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d hits, %d misses, %d blobs, %d bytes", s.Hits, s.Misses, s.Blobs, s.Bytes)
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCacheConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) ContextStore {
+		return NewCacheStore(NewFileStore(t.TempDir()), t.TempDir(), 1<<20)
+	})
+}
+
+func TestCacheHitsAndEviction(t *testing.T) {
+	backing := NewFileStore(t.TempDir())
+	dir := t.TempDir()
+	st := NewCacheStore(backing, dir, 20)
+
+	addresses := make([]Address, 0)
+	for _, blob := range []string{"thumbnail one", "thumbnail two"} {
+		a, err := st.Put(strings.NewReader(blob))
+		if err != nil {
+			t.Fatalf("st.Put returned an error: %v", err)
+		}
+		addresses = append(addresses, a)
+	}
+
+	var buf bytes.Buffer
+	for n := 0; n < 3; n++ {
+		buf.Reset()
+		err := st.GetAddress(addresses[0], &buf)
+		if err != nil {
+			t.Errorf("st.GetAddress returned an error: %v", err)
+		}
+
+		if buf.String() != "thumbnail one" {
+			t.Errorf("st.GetAddress returned the wrong bytes, got %q", buf.String())
+		}
+	}
+
+	stats := st.Stats()
+	if stats.Misses != 1 || stats.Hits != 2 {
+		t.Errorf("Expected 1 miss and 2 hits, got %v", stats)
+	}
+
+	// The second blob doesn't fit with the first one, so the first is evicted
+	err := st.GetAddress(addresses[1], &buf)
+	if err != nil {
+		t.Errorf("st.GetAddress returned an error: %v", err)
+	}
+
+	stats = st.Stats()
+	if stats.Blobs != 1 || stats.Bytes != addresses[1].Size {
+		t.Errorf("The cache should only have the second blob, got %v", stats)
+	}
+
+	_, err = NewFileStore(dir).Describe(addresses[0].Score)
+	if err == nil {
+		t.Errorf("The evicted blob should have been removed from the cache directory")
+	}
+
+	// Reading from the cache directory after the backing store loses the blob
+	err = backing.Delete(addresses[1].Score)
+	if err != nil {
+		t.Fatalf("Could not delete blob: %v", err)
+	}
+
+	buf.Reset()
+	err = NewCacheStore(backing, dir, 20).GetAddress(addresses[1], &buf)
+	if err != nil {
+		t.Errorf("A new cache on the same directory should have the blob, got %v", err)
+	}
+
+	if buf.String() != "thumbnail two" {
+		t.Errorf("st.GetAddress returned the wrong bytes, got %q", buf.String())
+	}
+}
+
+func TestCacheDeleteAndMisses(t *testing.T) {
+	backing := NewFileStore(t.TempDir())
+	dir := t.TempDir()
+	st := NewCacheStore(backing, dir, 1<<20)
+
+	blob := []byte("cached, then deleted")
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = st.GetAddress(a, &buf)
+	if err != nil {
+		t.Fatalf("st.GetAddress returned an error: %v", err)
+	}
+
+	// Lose the cached copy behind the cache's back, so reading it again is a miss
+	err = NewFileStore(dir).Delete(a.Score)
+	if err != nil {
+		t.Fatalf("Could not delete cached copy: %v", err)
+	}
+
+	buf.Reset()
+	err = st.Get(a.Score, &buf)
+	if err != nil || buf.String() != string(blob) {
+		t.Errorf("st.Get should have read from the backing store, got %q, %v", buf.String(), err)
+	}
+
+	stats := st.Stats()
+	if stats.Hits != 0 || stats.Misses != 2 {
+		t.Errorf("Reads the cache couldn't serve should be misses, got %v", stats)
+	}
+
+	// A new cache that hasn't been used yet still removes the cached copy, even by its legacy score
+	err = NewCacheStore(backing, dir, 1<<20).Delete(legacyScore(blob))
+	if err != nil {
+		t.Fatalf("Delete returned an error: %v", err)
+	}
+
+	_, err = NewFileStore(dir).Describe(a.Score)
+	if err != ErrNotExist {
+		t.Errorf("The cached copy should have been deleted, got %v", err)
+	}
+}
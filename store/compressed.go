@@ -0,0 +1,433 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	gzipCodec        = "gzip" // The blob is compressed with gzip
+	rawCodec         = "raw"  // The blob didn't get smaller when compressed, so it is stored as is
+	gzipHeaderLength = 512    // Enough of a compressed blob to read its gzip header
+)
+
+var (
+	ErrInUse = errors.New("Blob is used by another score") // CompressedStore.Delete will return this error instead of deleting a stored blob that another Score still needs
+)
+
+// gzipExtraId is the id of the gzip extra field that has the score and size of the original bytes
+var gzipExtraId = [2]byte{'P', 'K'}
+
+// CompressedStore is a store that compresses blobs with gzip before putting them into another store.
+//
+// Score is still the hash of the original bytes, so blobs dedupe and verify the same way they do in any other store.
+// Blobs that don't get smaller are stored as is. Addresses from a CompressedStore have a Location of <codec>://<score in the underlying store>.
+//
+// Compressed blobs have the Score and size of the original bytes in their gzip header, and the underlying store finds them by an alias made from the Score,
+// so the underlying store must be an Aliaser. Blobs that were put into the underlying store directly are read as raw blobs.
+//
+// Every blob in the underlying store is used by exactly one Score: its own if it is raw, or the one in its header if it is compressed.
+// Blobs that look like a compressed blob are compressed again instead of being stored raw, so Delete never removes a blob that another Score needs.
+type CompressedStore struct {
+	st    Store
+	level int
+}
+
+func NewCompressedStore(st Store) *CompressedStore {
+	return &CompressedStore{
+		st:    st,
+		level: gzip.DefaultCompression,
+	}
+}
+
+// SetLevel sets the gzip compression level used for new blobs
+func (s *CompressedStore) SetLevel(level int) *CompressedStore {
+	s.level = level
+	return s
+}
+
+// alias is the score a compressed blob can be found by in the underlying store
+func (s *CompressedStore) alias(score string) string {
+	h := newScoreHash()
+	io.WriteString(h, "packrat compressed "+score)
+	return FormatScore(DefaultHash, h.Sum(nil))
+}
+
+func compressedLocation(codec, score string) string {
+	return codec + "://" + score
+}
+
+// resolveCompressedUri returns the codec and underlying score from the Location of a compressed blob
+func resolveCompressedUri(uri string) (string, string, error) {
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) != 2 || (parts[0] != gzipCodec && parts[0] != rawCodec) {
+		return "", "", fmt.Errorf("Invalid compressed uri: %q", uri)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// gzipExtra makes a gzip extra field with the score and size of the original bytes
+func gzipExtra(score string, size int64) []byte {
+	data := fmt.Sprintf("%s %d", score, size)
+	extra := append([]byte{}, gzipExtraId[:]...)
+	extra = append(extra, byte(len(data)), byte(len(data)>>8))
+	return append(extra, data...)
+}
+
+// parseGzipExtra finds the score and size of the original bytes in a gzip extra field. ok is false if it doesn't have them.
+func parseGzipExtra(extra []byte) (score string, size int64, ok bool) {
+	for len(extra) >= 4 {
+		length := int(extra[2]) | int(extra[3])<<8
+		if len(extra) < 4+length {
+			return "", 0, false
+		}
+
+		if extra[0] == gzipExtraId[0] && extra[1] == gzipExtraId[1] {
+			_, err := fmt.Sscanf(string(extra[4:4+length]), "%s %d", &score, &size)
+			return score, size, err == nil && validScore(score)
+		}
+		extra = extra[4+length:]
+	}
+
+	return "", 0, false
+}
+
+// readGzipExtra reads the header of a blob and returns the score and size of the original bytes if it is a compressed blob
+func readGzipExtra(r io.Reader) (string, int64, bool) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return parseGzipExtra(zr.Header.Extra)
+}
+
+// owner returns the score and size of the original bytes of a compressed blob in the underlying store. ok is false if it is a raw blob.
+func (s *CompressedStore) owner(ctx context.Context, stored Address) (score string, size int64, ok bool, err error) {
+	var buf bytes.Buffer
+	err = withContext(s.st).GetRangeContext(ctx, stored, 0, gzipHeaderLength, &buf)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	score, size, ok = readGzipExtra(&buf)
+	return score, size, ok, nil
+}
+
+func (s *CompressedStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+func (s *CompressedStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	var a Address
+
+	aliaser, ok := s.st.(Aliaser)
+	if !ok {
+		return a, ErrNoAliases
+	}
+
+	// Stage the original bytes so they can be hashed before they are compressed
+	tmp, err := ioutil.TempFile("", "pkrt-staging")
+	if err != nil {
+		return a, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := newScoreHash()
+	length, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx, r})
+	a.Size = length
+	if err != nil {
+		return a, err
+	}
+
+	a.Score = FormatScore(DefaultHash, h.Sum(nil))
+
+	// If the blob is already in the store, return its Address, unless it is only there as the compressed blob of another score
+	describedA, err := s.DescribeContext(ctx, a.Score)
+	if err == nil {
+		inUse, err := s.inUse(ctx, describedA)
+		if err != nil {
+			return a, err
+		}
+		if !inUse {
+			return describedA, nil
+		}
+	}
+
+	compressed, err := ioutil.TempFile("", "pkrt-staging")
+	if err != nil {
+		return a, err
+	}
+	defer os.Remove(compressed.Name())
+	defer compressed.Close()
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return a, err
+	}
+
+	err = s.compress(a, tmp, compressed)
+	if err != nil {
+		return a, err
+	}
+
+	// Keep whichever is smaller, unless storing it raw would make it look like the compressed blob of another score
+	codec, stage := gzipCodec, compressed
+	info, err := compressed.Stat()
+	if err != nil {
+		return a, err
+	}
+	if info.Size() >= a.Size {
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return a, err
+		}
+
+		if _, _, ok := readGzipExtra(tmp); !ok {
+			codec, stage = rawCodec, tmp
+		}
+	}
+
+	_, err = stage.Seek(0, io.SeekStart)
+	if err != nil {
+		return a, err
+	}
+
+	stored, err := withContext(s.st).PutContext(ctx, stage)
+	if err != nil {
+		return a, err
+	}
+
+	if codec == gzipCodec {
+		err = addAliasContext(ctx, aliaser, stored.Score, s.alias(a.Score))
+		if err != nil {
+			return a, err
+		}
+	}
+
+	a.Location = compressedLocation(codec, stored.Score)
+	return a, nil
+}
+
+// compress writes the gzip of r to w, with a's Score and Size in the header
+func (s *CompressedStore) compress(a Address, r io.Reader, w io.Writer) error {
+	zw, err := gzip.NewWriterLevel(w, s.level)
+	if err != nil {
+		return err
+	}
+	zw.Header.Extra = gzipExtra(a.Score, a.Size)
+
+	_, err = io.Copy(zw, r)
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func (s *CompressedStore) Get(score string, w io.Writer) error {
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *CompressedStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	addr, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	return s.GetAddressContext(ctx, addr, w)
+}
+
+func (s *CompressedStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *CompressedStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	return s.GetRangeContext(ctx, a, 0, a.Size, w)
+}
+
+// GetRange has to decompress a gzip blob from the start, since gzip can't seek
+func (s *CompressedStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *CompressedStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	n, err := clampRange(a, off, n)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	codec, score, err := resolveCompressedUri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	stored, err := withContext(s.st).DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	if codec == rawCodec {
+		return withContext(s.st).GetRangeContext(ctx, stored, off, n, w)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(withContext(s.st).GetAddressContext(ctx, stored, pw))
+	}()
+	defer pr.CloseWithError(io.ErrClosedPipe)
+
+	zr, err := gzip.NewReader(pr)
+	if err != nil {
+		return ErrCorrupt
+	}
+
+	written, err := io.Copy(&rangeWriter{w: w, skip: off, n: n}, io.LimitReader(zr, off+n))
+	if err == gzip.ErrChecksum || err == gzip.ErrHeader {
+		return ErrCorrupt
+	}
+	if err != nil {
+		return err
+	}
+
+	if written < off+n {
+		return ErrTruncated
+	}
+
+	return nil
+}
+
+// Describe finds a compressed blob by the alias of any spelling of its score, and then a raw blob by its score. The Address has the score the blob was put with.
+func (s *CompressedStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
+
+func (s *CompressedStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	if !validScore(score) {
+		return Address{Score: score}, fmt.Errorf("Invalid score: %q", score)
+	}
+
+	for _, spelling := range scoreSpellings(score) {
+		stored, err := withContext(s.st).DescribeContext(ctx, s.alias(spelling))
+		if isNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Address{Score: score}, err
+		}
+
+		owner, size, ok, err := s.owner(ctx, stored)
+		if err != nil {
+			return Address{Score: score}, err
+		}
+		if !ok || !SameBlob(owner, spelling) {
+			return Address{Score: score}, ErrCorrupt
+		}
+
+		return Address{
+			Score:    spelling,
+			Location: compressedLocation(gzipCodec, stored.Score),
+			Size:     size,
+		}, nil
+	}
+
+	// It might have been stored raw, or put into the underlying store directly
+	a, err := withContext(s.st).DescribeContext(ctx, score)
+	if err != nil {
+		return Address{Score: score}, err
+	}
+
+	a.Location = compressedLocation(rawCodec, a.Score)
+	return a, nil
+}
+
+// Delete removes the stored blob, as long as no other score uses it
+func (s *CompressedStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *CompressedStore) DeleteContext(ctx context.Context, score string) error {
+	a, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	inUse, err := s.inUse(ctx, a)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrInUse
+	}
+
+	_, storedScore, err := resolveCompressedUri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	// The alias stops working once the compressed blob is gone
+	return withContext(s.st).DeleteContext(ctx, storedScore)
+}
+
+// inUse reports whether a raw blob is also the compressed blob of another score, which happens when it was put into the underlying store directly
+func (s *CompressedStore) inUse(ctx context.Context, a Address) (bool, error) {
+	codec, storedScore, err := resolveCompressedUri(a.Location)
+	if err != nil || codec != rawCodec {
+		return false, err
+	}
+
+	stored, err := withContext(s.st).DescribeContext(ctx, storedScore)
+	if err != nil {
+		return false, err
+	}
+
+	owner, _, ok, err := s.owner(ctx, stored)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	described, err := s.DescribeContext(ctx, owner)
+	if isNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return described.Location == compressedLocation(gzipCodec, storedScore), nil
+}
+
+// Walk lists the blobs in the underlying store. Compressed blobs are listed by the Score in their header.
+func (s *CompressedStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *CompressedStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	return withContext(s.st).WalkContext(ctx, func(stored Address) bool {
+		a := Address{
+			Score:    stored.Score,
+			Location: compressedLocation(rawCodec, stored.Score),
+			Size:     stored.Size,
+		}
+
+		owner, size, ok, err := s.owner(ctx, stored)
+		if err == nil && ok {
+			a = Address{
+				Score:    owner,
+				Location: compressedLocation(gzipCodec, stored.Score),
+				Size:     size,
+			}
+		}
+
+		return fn(a)
+	})
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func newTestCompressedStore(t *testing.T) (*CompressedStore, *FileStore) {
+	underlying := NewFileStore(t.TempDir())
+	return NewCompressedStore(underlying), underlying
+}
+
+func TestCompressedConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) ContextStore {
+		st, _ := newTestCompressedStore(t)
+		return st
+	})
+}
+
+func TestCompressedCodecs(t *testing.T) {
+	st, underlying := newTestCompressedStore(t)
+
+	text := []byte(strings.Repeat(`{"camera": "pinhole", "exposure": "long"}`+"\n", 1000))
+	noise := make([]byte, 4096)
+	_, err := rand.Read(noise)
+	if err != nil {
+		t.Fatalf("Could not make random blob: %v", err)
+	}
+
+	for _, tc := range []struct {
+		blob  []byte
+		codec string
+	}{
+		{text, gzipCodec},
+		{noise, rawCodec},
+	} {
+		a, err := st.Put(bytes.NewReader(tc.blob))
+		if err != nil {
+			t.Fatalf("st.Put returned an error: %v", err)
+		}
+
+		if a.Score != score(tc.blob) || a.Size != int64(len(tc.blob)) {
+			t.Errorf("Address should describe the original bytes, got %+v", a)
+		}
+
+		codec, storedScore, err := resolveCompressedUri(a.Location)
+		if err != nil || codec != tc.codec {
+			t.Errorf("Expected a %s blob, got location %q", tc.codec, a.Location)
+		}
+
+		stored, err := underlying.Describe(storedScore)
+		if err != nil {
+			t.Fatalf("The blob isn't in the underlying store: %v", err)
+		}
+
+		if codec == gzipCodec && stored.Size >= a.Size {
+			t.Errorf("Compressed blob should be smaller, got %d bytes for %d", stored.Size, a.Size)
+		}
+
+		err = Verify(st, a)
+		if err != nil {
+			t.Errorf("Verify returned an error: %v", err)
+		}
+	}
+
+	// Blobs put into the underlying store directly can still be read
+	direct := []byte("put before compression was turned on")
+	_, err = underlying.Put(bytes.NewReader(direct))
+	if err != nil {
+		t.Fatalf("underlying.Put returned an error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = st.Get(score(direct), &buf)
+	if err != nil {
+		t.Errorf("st.Get returned an error for a blob put directly: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), direct) {
+		t.Errorf("st.Get returned the wrong bytes, got %q", buf.Bytes())
+	}
+
+	walked := 0
+	err = st.Walk(func(a Address) bool {
+		walked++
+		return true
+	})
+	if err != nil || walked != 3 {
+		t.Errorf("Expected to walk 3 blobs, walked %d: %v", walked, err)
+	}
+}
+
+func TestCompressedNewStore(t *testing.T) {
+	st, underlying := newTestCompressedStore(t)
+
+	blob := strings.Repeat("nothing kept on the side\n", 100)
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	// Everything needed to find the blob is in the underlying store
+	reopened := NewCompressedStore(underlying)
+	described, err := reopened.Describe(a.Score)
+	if err != nil || described != a {
+		t.Errorf("A new store should find the blob. Expected %+v, got %+v, %v", a, described, err)
+	}
+
+	var walked []Address
+	err = reopened.Walk(func(a Address) bool {
+		walked = append(walked, a)
+		return true
+	})
+	if err != nil || len(walked) != 1 || walked[0] != a {
+		t.Errorf("A new store should walk the blob. Expected %+v, got %+v, %v", a, walked, err)
+	}
+
+	var buf bytes.Buffer
+	err = reopened.Get(a.Score, &buf)
+	if err != nil || buf.String() != blob {
+		t.Errorf("A new store should read the blob. Expected %q, got %q, %v", blob, buf.String(), err)
+	}
+}
+
+func TestCompressedSharedBlob(t *testing.T) {
+	st, underlying := newTestCompressedStore(t)
+
+	text := []byte(strings.Repeat("compressed once\n", 100))
+	a, err := st.Put(bytes.NewReader(text))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	_, storedScore, _ := resolveCompressedUri(a.Location)
+	var stored bytes.Buffer
+	err = underlying.Get(storedScore, &stored)
+	if err != nil {
+		t.Fatalf("underlying.Get returned an error: %v", err)
+	}
+
+	// Putting the compressed bytes through the store compresses them again instead of sharing the blob
+	again, err := st.Put(bytes.NewReader(stored.Bytes()))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	if again.Location == a.Location {
+		t.Errorf("The compressed bytes should get their own blob, got %+v", again)
+	}
+
+	err = st.Delete(again.Score)
+	if err != nil {
+		t.Errorf("st.Delete returned an error: %v", err)
+	}
+
+	_, err = st.Describe(a.Score)
+	if err != nil {
+		t.Errorf("Deleting another blob should not delete %s: %v", a.Score, err)
+	}
+
+	// The compressed blob is still used by the original bytes, so it can't be deleted by its own score
+	err = st.Delete(storedScore)
+	if err != ErrInUse {
+		t.Errorf("Expected ErrInUse deleting a blob another score uses, got %v", err)
+	}
+
+	err = st.Delete(a.Score)
+	if err != nil {
+		t.Errorf("st.Delete returned an error: %v", err)
+	}
+
+	_, err = underlying.Describe(storedScore)
+	if err == nil {
+		t.Errorf("Deleting %s should delete its compressed blob", a.Score)
+	}
+}
+
+func TestCompressedNoAliases(t *testing.T) {
+	st := NewCompressedStore(NewMirrorStore(0, NewFileStore(t.TempDir())))
+
+	_, err := st.Put(strings.NewReader("nowhere to go"))
+	if err != ErrNoAliases {
+		t.Errorf("st.Put should have returned ErrNoAliases for a store without aliases, got %v", err)
+	}
+}
@@ -0,0 +1,476 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	encUriPrefix = "enc://"
+	encMagic     = "PKRTENC1"
+	encChunkSize = 64 << 10
+	encOverhead  = 16 // GCM tag on every chunk
+)
+
+// EncryptedStore is a store that encrypts blobs before putting them into another store.
+//
+// Blobs are encrypted with AES-GCM in chunks of encChunkSize, with a key derived from the store's key and the blob's Score.
+// The same plaintext always makes the same ciphertext, so blobs still dedupe in the underlying store, and Score is still the hash of the plaintext.
+//
+// The underlying store only knows the hash of the ciphertext, so EncryptedStore aliases the ciphertext with an HMAC of the Score, which doesn't reveal what is in the store.
+// The underlying store must be an Aliaser. The ciphertext starts with the Score, encrypted, so Walk can find the blobs without the aliases.
+// Addresses from an EncryptedStore have a Location of enc://<ciphertext score>.
+type EncryptedStore struct {
+	st  Store
+	key []byte
+}
+
+func NewEncryptedStore(st Store, key []byte) *EncryptedStore {
+	return &EncryptedStore{
+		st:  st,
+		key: key,
+	}
+}
+
+func (s *EncryptedStore) mac(purpose, score string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(purpose + score))
+	return mac.Sum(nil)
+}
+
+// alias is the score the ciphertext of a blob can be found by in the underlying store
+func (s *EncryptedStore) alias(score string) string {
+	return FormatScore("sha256", s.mac("ref", score))
+}
+
+// refCipher returns the cipher for the scores at the start of ciphertexts
+func (s *EncryptedStore) refCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.mac("ref-key", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealScore encrypts a score for the start of its ciphertext. The nonce comes from the score's alias, which is different for every score.
+func (s *EncryptedStore) sealScore(score string) ([]byte, error) {
+	aead, err := s.refCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := s.mac("ref", score)[:aead.NonceSize()]
+	return append(nonce, aead.Seal(nil, nonce, []byte(score), nil)...), nil
+}
+
+func (s *EncryptedStore) openScore(sealed []byte) (string, error) {
+	aead, err := s.refCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrCorrupt
+	}
+
+	score, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrCorrupt
+	}
+
+	return string(score), nil
+}
+
+// blobCipher returns the cipher for a blob. Every blob has its own key, so the nonces only need to be unique within a blob.
+func (s *EncryptedStore) blobCipher(score string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.mac("blob", score))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the chunk number followed by a flag for the last chunk, so chunks can't be reordered or dropped from the end
+func chunkNonce(n int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(n))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// chunkCount returns how many chunks a blob of size bytes is encrypted in. Empty blobs still have one chunk.
+func chunkCount(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + encChunkSize - 1) / encChunkSize
+}
+
+// chunkLength returns how many bytes of plaintext are in chunk n of a blob
+func chunkLength(n, size int64) int64 {
+	remaining := size - n*encChunkSize
+	if remaining > encChunkSize {
+		return encChunkSize
+	}
+	return remaining
+}
+
+// headerLength returns how many bytes a ciphertext has before its first chunk: the magic, the length of the sealed score, and the sealed score
+func headerLength(sealed int) int64 {
+	return int64(len(encMagic)) + 2 + int64(sealed)
+}
+
+// sealedLength returns how long score is once it has been sealed
+func sealedLength(score string) int {
+	return 12 + len(score) + encOverhead
+}
+
+func chunkOffset(header, n int64) int64 {
+	return header + n*(encChunkSize+encOverhead)
+}
+
+// plaintextSize returns the size of a blob from the size of its ciphertext
+func plaintextSize(header, size int64) int64 {
+	sealed := size - header
+	chunks := (sealed + encChunkSize + encOverhead - 1) / (encChunkSize + encOverhead)
+	if chunks < 1 {
+		chunks = 1
+	}
+	return sealed - chunks*encOverhead
+}
+
+func encrypt(aead cipher.AEAD, sealed []byte, r io.Reader, size int64, w io.Writer) error {
+	header := make([]byte, 0, headerLength(len(sealed)))
+	header = append(header, encMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(sealed)))
+	header = append(header, sealed...)
+
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	chunks := chunkCount(size)
+	buf := make([]byte, encChunkSize, encChunkSize+encOverhead)
+	for n := int64(0); n < chunks; n++ {
+		plain := buf[:chunkLength(n, size)]
+		_, err := io.ReadFull(r, plain)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(aead.Seal(plain[:0], chunkNonce(n, n == chunks-1), plain, nil))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decrypt reads chunks first through last of a blob of size bytes from r and writes their plaintext to w
+func decrypt(aead cipher.AEAD, r io.Reader, first, last, size int64, w io.Writer) error {
+	chunks := chunkCount(size)
+	buf := make([]byte, encChunkSize+encOverhead)
+	for n := first; n <= last; n++ {
+		sealed := buf[:chunkLength(n, size)+encOverhead]
+		_, err := io.ReadFull(r, sealed)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		if err != nil {
+			return err
+		}
+
+		plain, err := aead.Open(sealed[:0], chunkNonce(n, n == chunks-1), sealed, nil)
+		if err != nil {
+			return ErrCorrupt
+		}
+
+		_, err = w.Write(plain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *EncryptedStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+func (s *EncryptedStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	var a Address
+
+	aliaser, ok := s.st.(Aliaser)
+	if !ok {
+		return a, ErrNoAliases
+	}
+
+	// Stage the plaintext so it can be hashed before it is encrypted
+	tmp, err := ioutil.TempFile("", "pkrt-staging")
+	if err != nil {
+		return a, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := newScoreHash()
+	length, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx, r})
+	a.Size = length
+	if err != nil {
+		return a, err
+	}
+
+	a.Score = FormatScore(DefaultHash, h.Sum(nil))
+
+	// If the blob is already in the store, return its Address
+	describedA, err := s.DescribeContext(ctx, a.Score)
+	if err == nil {
+		return describedA, nil
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return a, err
+	}
+
+	aead, err := s.blobCipher(a.Score)
+	if err != nil {
+		return a, err
+	}
+
+	sealed, err := s.sealScore(a.Score)
+	if err != nil {
+		return a, err
+	}
+
+	// Encrypt straight into the underlying store
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encrypt(aead, sealed, tmp, a.Size, pw))
+	}()
+
+	encrypted, err := withContext(s.st).PutContext(ctx, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return a, err
+	}
+
+	err = addAliasContext(ctx, aliaser, encrypted.Score, s.alias(a.Score))
+	if err != nil {
+		return a, err
+	}
+
+	a.Location = encUriPrefix + encrypted.Score
+	return a, nil
+}
+
+func (s *EncryptedStore) Get(score string, w io.Writer) error {
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *EncryptedStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	addr, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	return s.GetAddressContext(ctx, addr, w)
+}
+
+func resolveEncUri(uri string) (string, error) {
+	if !strings.HasPrefix(uri, encUriPrefix) {
+		return "", fmt.Errorf("Invalid enc uri: %q", uri)
+	}
+
+	return uri[len(encUriPrefix):], nil
+}
+
+// encryptedAddress returns the Address of a blob's ciphertext in the underlying store
+func (s *EncryptedStore) encryptedAddress(ctx context.Context, a Address) (Address, error) {
+	score, err := resolveEncUri(a.Location)
+	if err != nil {
+		return Address{}, err
+	}
+
+	return withContext(s.st).DescribeContext(ctx, score)
+}
+
+func (s *EncryptedStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *EncryptedStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	return s.GetRangeContext(ctx, a, 0, a.Size, w)
+}
+
+// rangeWriter throws away the first skip bytes written to it, and then writes the next n bytes to w
+type rangeWriter struct {
+	w       io.Writer
+	skip, n int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	if r.skip >= int64(len(p)) {
+		r.skip -= int64(len(p))
+		return written, nil
+	}
+	p = p[r.skip:]
+	r.skip = 0
+
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	r.n -= int64(len(p))
+
+	_, err := r.w.Write(p)
+	return written, err
+}
+
+func (s *EncryptedStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *EncryptedStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	n, err := clampRange(a, off, n)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	encrypted, err := s.encryptedAddress(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	aead, err := s.blobCipher(a.Score)
+	if err != nil {
+		return err
+	}
+
+	// Only the chunks with bytes in the range need to be read and decrypted
+	header := headerLength(sealedLength(a.Score))
+	first := off / encChunkSize
+	last := (off + n - 1) / encChunkSize
+	start := chunkOffset(header, first)
+	length := chunkOffset(header, last) + chunkLength(last, a.Size) + encOverhead - start
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(withContext(s.st).GetRangeContext(ctx, encrypted, start, length, pw))
+	}()
+	defer pr.CloseWithError(io.ErrClosedPipe)
+
+	return decrypt(aead, pr, first, last, a.Size, &rangeWriter{w: w, skip: off - first*encChunkSize, n: n})
+}
+
+// Describe finds the ciphertext of a blob by the alias of any spelling of its score. The Address has the score the blob was encrypted with.
+func (s *EncryptedStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
+
+func (s *EncryptedStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	for _, spelling := range scoreSpellings(score) {
+		encrypted, err := withContext(s.st).DescribeContext(ctx, s.alias(spelling))
+		if isNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Address{Score: score}, err
+		}
+
+		return Address{
+			Score:    spelling,
+			Location: encUriPrefix + encrypted.Score,
+			Size:     plaintextSize(headerLength(sealedLength(spelling)), encrypted.Size),
+		}, nil
+	}
+
+	return Address{Score: score}, ErrNotExist
+}
+
+func (s *EncryptedStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *EncryptedStore) DeleteContext(ctx context.Context, score string) error {
+	a, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	encryptedScore, err := resolveEncUri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	// The alias stops working once the ciphertext is gone
+	return withContext(s.st).DeleteContext(ctx, encryptedScore)
+}
+
+// openHeader reads the score at the start of a ciphertext in the underlying store
+func (s *EncryptedStore) openHeader(ctx context.Context, encrypted Address) (string, error) {
+	var buf bytes.Buffer
+	err := withContext(s.st).GetRangeContext(ctx, encrypted, 0, headerLength(math.MaxUint16), &buf)
+	if err != nil {
+		return "", err
+	}
+
+	header := buf.Bytes()
+	if len(header) < len(encMagic)+2 || string(header[:len(encMagic)]) != encMagic {
+		return "", ErrCorrupt
+	}
+
+	length := int(binary.BigEndian.Uint16(header[len(encMagic):]))
+	sealed := header[len(encMagic)+2:]
+	if len(sealed) < length {
+		return "", ErrCorrupt
+	}
+
+	return s.openScore(sealed[:length])
+}
+
+// Walk reads the score at the start of every ciphertext in the underlying store. Blobs that weren't encrypted with the store's key are skipped.
+func (s *EncryptedStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *EncryptedStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	return withContext(s.st).WalkContext(ctx, func(encrypted Address) bool {
+		score, err := s.openHeader(ctx, encrypted)
+		if err == ErrCorrupt {
+			return true
+		}
+		if err != nil {
+			log.Printf("Skipping blob %q, its header can't be read: %v", encrypted.Score, err)
+			return true
+		}
+
+		a := Address{
+			Score:    score,
+			Location: encUriPrefix + encrypted.Score,
+			Size:     plaintextSize(headerLength(sealedLength(score)), encrypted.Size),
+		}
+
+		return fn(a)
+	})
+}
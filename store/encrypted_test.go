@@ -0,0 +1,166 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestEncryptedStore(t *testing.T) (*EncryptedStore, *FileStore) {
+	underlying := NewFileStore(t.TempDir())
+	key := make([]byte, keyLength)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("Could not make key: %v", err)
+	}
+	return NewEncryptedStore(underlying, key), underlying
+}
+
+func TestEncryptedConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) ContextStore {
+		st, _ := newTestEncryptedStore(t)
+		return st
+	})
+}
+
+func TestEncryptedCiphertext(t *testing.T) {
+	st, underlying := newTestEncryptedStore(t)
+
+	// Big enough to be split into a few chunks
+	blob := bytes.Repeat([]byte("family photos "), encChunkSize/4)
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	if a.Score != score(blob) {
+		t.Errorf("Score should be the hash of the plaintext. Expected %q, got %q", score(blob), a.Score)
+	}
+
+	encrypted, err := st.encryptedAddress(context.Background(), a)
+	if err != nil {
+		t.Fatalf("Could not find the ciphertext: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = underlying.GetAddress(encrypted, &buf)
+	if err != nil {
+		t.Fatalf("Could not read the ciphertext: %v", err)
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte("family photos")) {
+		t.Errorf("The underlying store has plaintext in it")
+	}
+
+	// The same plaintext should make the same ciphertext
+	other := NewEncryptedStore(underlying, st.key)
+	again, err := other.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+
+	if again.Location != a.Location {
+		t.Errorf("The same plaintext should dedupe in the underlying store. Expected %q, got %q", a.Location, again.Location)
+	}
+
+	// Reading across chunks
+	buf.Reset()
+	off := int64(encChunkSize - 5)
+	err = st.GetRange(a, off, 10, &buf)
+	if err != nil {
+		t.Errorf("st.GetRange returned an error: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), blob[off:off+10]) {
+		t.Errorf("st.GetRange returned the wrong bytes. Expected %q, got %q", blob[off:off+10], buf.Bytes())
+	}
+
+	err = Verify(st, a)
+	if err != nil {
+		t.Errorf("Verify returned an error: %v", err)
+	}
+
+	// A different key can't read it
+	wrongKey := NewEncryptedStore(underlying, bytes.Repeat([]byte{1}, keyLength))
+	err = wrongKey.GetAddress(a, &buf)
+	if err != ErrCorrupt {
+		t.Errorf("Reading with the wrong key should have returned ErrCorrupt, got %v", err)
+	}
+
+	_, err = wrongKey.Describe(a.Score)
+	if err != ErrNotExist {
+		t.Errorf("A different key should not find the blob, got %v", err)
+	}
+
+	walked := 0
+	err = wrongKey.Walk(func(a Address) bool {
+		walked++
+		return true
+	})
+	if err != nil || walked != 0 {
+		t.Errorf("A different key should not walk any blobs, got %d, %v", walked, err)
+	}
+}
+
+func TestEncryptedNewStore(t *testing.T) {
+	st, underlying := newTestEncryptedStore(t)
+
+	blob := "nothing kept on the side"
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	// Everything needed to find the blob is in the underlying store
+	reopened := NewEncryptedStore(underlying, st.key)
+	described, err := reopened.Describe(a.Score)
+	if err != nil || described != a {
+		t.Errorf("A new store should find the blob. Expected %+v, got %+v, %v", a, described, err)
+	}
+
+	var walked []Address
+	err = reopened.Walk(func(a Address) bool {
+		walked = append(walked, a)
+		return true
+	})
+	if err != nil || len(walked) != 1 || walked[0] != a {
+		t.Errorf("A new store should walk the blob. Expected %+v, got %+v, %v", a, walked, err)
+	}
+
+	var buf bytes.Buffer
+	err = reopened.Get(a.Score, &buf)
+	if err != nil || buf.String() != blob {
+		t.Errorf("A new store should read the blob. Expected %q, got %q, %v", blob, buf.String(), err)
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "key")
+
+	key, err := CreateKeyFile(filename, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("CreateKeyFile returned an error: %v", err)
+	}
+
+	loaded, err := LoadKeyFile(filename, "correct horse battery staple")
+	if err != nil {
+		t.Errorf("LoadKeyFile returned an error: %v", err)
+	}
+
+	if !bytes.Equal(key, loaded) {
+		t.Errorf("LoadKeyFile returned a different key than CreateKeyFile")
+	}
+
+	_, err = LoadKeyFile(filename, "incorrect horse")
+	if err != ErrWrongPassphrase {
+		t.Errorf("LoadKeyFile should have returned ErrWrongPassphrase, got %v", err)
+	}
+
+	_, err = CreateKeyFile(filename, "another passphrase")
+	if err == nil || !strings.Contains(err.Error(), "exists") {
+		t.Errorf("CreateKeyFile should not overwrite a key file, got %v", err)
+	}
+}
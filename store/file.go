@@ -0,0 +1,397 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	fileUriPrefix = "file://"
+	blobFileMode  = 0444 // blobs never change once they are stored
+)
+
+// FileStore is a store that keeps blobs as files in a directory on the local filesystem.
+//
+// Blobs are stored at <root>/blobs/<score>. There is no separate index, the directory is the index.
+// Aliases are files at <root>/aliases/<alias> that have the score of a blob in them.
+type FileStore struct {
+	root string // Directory that holds the blobs directory
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{
+		root: root,
+	}
+}
+
+func (s *FileStore) blobDir() string {
+	return filepath.Join(s.root, blobPrefix)
+}
+
+func (s *FileStore) blobPath(score string) string {
+	return filepath.Join(s.blobDir(), score)
+}
+
+func (s *FileStore) aliasDir() string {
+	return filepath.Join(s.root, "aliases")
+}
+
+// validScore tells if a score is safe to use as a file name
+func validScore(score string) bool {
+	_, _, err := ParseScore(score)
+	return err == nil
+}
+
+func (s *FileStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+func (s *FileStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	var a Address
+
+	err := os.MkdirAll(s.blobDir(), 0755)
+	if err != nil {
+		return a, err
+	}
+
+	// Stage the blob next to where it will end up so it can be renamed into place
+	tmp, err := ioutil.TempFile(s.blobDir(), ".pkrt-staging")
+	if err != nil {
+		return a, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Hash the bytes while they are written to the staging file
+	h := newScoreHash()
+	length, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx, r})
+	a.Size = length
+	if err != nil {
+		return a, err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return a, err
+	}
+
+	a.Score = FormatScore(DefaultHash, h.Sum(nil))
+
+	// If the blob is already in the store, return its Address
+	describedA, err := s.Describe(a.Score)
+	if err == nil {
+		return describedA, nil
+	}
+
+	err = tmp.Chmod(blobFileMode)
+	if err != nil {
+		return a, err
+	}
+
+	err = os.Rename(tmp.Name(), s.blobPath(a.Score))
+	if err != nil {
+		return a, err
+	}
+
+	return s.Describe(a.Score)
+}
+
+func (s *FileStore) Get(score string, w io.Writer) error {
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *FileStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	addr, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	return s.GetAddressContext(ctx, addr, w)
+}
+
+func resolveFileUri(uri string) (string, error) {
+	if !strings.HasPrefix(uri, fileUriPrefix) {
+		return "", fmt.Errorf("Invalid file uri: %q", uri)
+	}
+
+	return uri[len(fileUriPrefix):], nil
+}
+
+// copyFileAddress writes the Size bytes at Offset of the file at a's Location to w.
+// Blobs in a FileStore start at the beginning of their file.
+func copyFileAddress(a Address, w io.Writer) error {
+	return copyFileRange(a, 0, a.Size, w)
+}
+
+// copyFileRange writes n bytes of the blob at a to w, starting off bytes into the blob
+func copyFileRange(a Address, off, n int64, w io.Writer) error {
+	n, err := clampRange(a, off, n)
+	if err != nil {
+		return err
+	}
+
+	path, err := resolveFileUri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	copied, err := io.Copy(w, io.NewSectionReader(f, a.Offset+off, n))
+	if err != nil {
+		return err
+	}
+
+	if copied != n {
+		return ErrTruncated
+	}
+
+	return nil
+}
+
+func (s *FileStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *FileStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	return copyFileAddress(a, contextWriter{ctx, w})
+}
+
+func (s *FileStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *FileStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	return copyFileRange(a, off, n, contextWriter{ctx, w})
+}
+
+// Describe finds a blob under any spelling of its score, and then by its aliases. The Address has the score the blob is stored under.
+func (s *FileStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
+
+func (s *FileStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	if err := ctx.Err(); err != nil {
+		return Address{Score: score}, err
+	}
+
+	if !validScore(score) {
+		return Address{Score: score}, fmt.Errorf("Invalid score: %q", score)
+	}
+
+	for _, spelling := range scoreSpellings(score) {
+		a, err := s.describe(spelling)
+		if !os.IsNotExist(err) {
+			return a, err
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.aliasDir(), score))
+	if err == nil && validScore(string(b)) {
+		a, err := s.describe(string(b))
+		if !os.IsNotExist(err) {
+			return a, err
+		}
+	}
+
+	return Address{Score: score}, ErrNotExist
+}
+
+// describe returns the Address of the blob stored under exactly score
+func (s *FileStore) describe(score string) (Address, error) {
+	a := Address{Score: score}
+
+	path, err := filepath.Abs(s.blobPath(score))
+	if err != nil {
+		return a, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return a, err
+	}
+
+	a.Location = fileUriPrefix + path
+	a.Size = info.Size()
+
+	return a, nil
+}
+
+func (s *FileStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *FileStore) DeleteContext(ctx context.Context, score string) error {
+	a, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	if !SameBlob(a.Score, score) {
+		return ErrAlias
+	}
+
+	err = os.Remove(s.blobPath(a.Score))
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
+
+func (s *FileStore) AddAlias(score, alias string) error {
+	if !validScore(alias) {
+		return fmt.Errorf("Invalid score: %q", alias)
+	}
+
+	a, err := s.Describe(score)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.aliasDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.aliasDir(), ".pkrt-staging")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.WriteString(tmp, a.Score)
+	if err != nil {
+		return err
+	}
+
+	// Link fails if the alias exists, where Rename would move it to this blob
+	path := filepath.Join(s.aliasDir(), alias)
+	err = os.Link(tmp.Name(), path)
+	if !os.IsExist(err) {
+		return err
+	}
+
+	existing, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(existing) == a.Score {
+		return nil
+	}
+
+	// Aliases are left behind when their blob is deleted, and those can be taken
+	if validScore(string(existing)) {
+		_, err = s.describe(string(existing))
+		if !os.IsNotExist(err) {
+			return ErrAliasInUse
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Replace(a Address, r io.Reader) error {
+	path, err := resolveFileUri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	algorithm, _, err := ParseScore(a.Score)
+	if err != nil {
+		return err
+	}
+
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".pkrt-staging")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+
+	if !SameBlob(FormatScore(algorithm, h.Sum(nil)), a.Score) {
+		return ErrCorrupt
+	}
+
+	err = tmp.Chmod(blobFileMode)
+	if err != nil {
+		return err
+	}
+
+	// The rename swaps the good copy in all at once, so the blob is never missing
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *FileStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.blobDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Read the directory a little at a time so huge stores don't have to fit in memory
+	for {
+		names, err := f.Readdirnames(1000)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// Skip staging files
+			if !validScore(name) {
+				continue
+			}
+
+			a, err := s.describe(name)
+			if err != nil {
+				// It was deleted while walking
+				continue
+			}
+
+			if !fn(a) {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) ContextStore {
+		return NewFileStore(t.TempDir())
+	})
+}
+
+func TestFileLocation(t *testing.T) {
+	root := t.TempDir()
+	st := NewFileStore(root)
+
+	a, err := st.Put(strings.NewReader("where am I"))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	expected := "file://" + filepath.Join(root, "blobs", a.Score)
+	if a.Location != expected {
+		t.Errorf("Location mismatched. Expected %q, got %q", expected, a.Location)
+	}
+
+	// A new store on the same directory should find the blob without any other index
+	described, err := NewFileStore(root).Describe(a.Score)
+	if err != nil {
+		t.Errorf("Describe on a new store returned an error: %v", err)
+	}
+
+	if described != a {
+		t.Errorf("Describe on a new store returned a different address. Expected %+v, got %+v", a, described)
+	}
+
+	_, err = st.Describe("../../etc/passwd")
+	if err == nil {
+		t.Errorf("Describe should not accept scores that are not hashes")
+	}
+}
+
+func TestFileLegacyScore(t *testing.T) {
+	root := t.TempDir()
+	st := NewFileStore(root)
+	blob := []byte("put before scores named their hash")
+
+	// Blobs used to be stored under the bare digest
+	err := os.MkdirAll(filepath.Join(root, "blobs"), 0755)
+	if err != nil {
+		t.Fatalf("Could not make blobs directory: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "blobs", legacyScore(blob)), blob, 0444)
+	if err != nil {
+		t.Fatalf("Could not write legacy blob: %v", err)
+	}
+
+	for _, s := range []string{legacyScore(blob), score(blob)} {
+		a, err := st.Describe(s)
+		if err != nil {
+			t.Errorf("st.Describe(%q) returned an error: %v", s, err)
+			continue
+		}
+
+		if a.Score != legacyScore(blob) {
+			t.Errorf("st.Describe should return the score the blob is stored under, got %q", a.Score)
+		}
+
+		err = Verify(st, a)
+		if err != nil {
+			t.Errorf("Verify returned an error for a legacy blob: %v", err)
+		}
+	}
+
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	if a.Score != legacyScore(blob) {
+		t.Errorf("st.Put should have found the legacy blob, got %+v", a)
+	}
+
+	err = st.Delete(score(blob))
+	if err != nil {
+		t.Errorf("st.Delete returned an error: %v", err)
+	}
+
+	_, err = st.Describe(legacyScore(blob))
+	if err == nil {
+		t.Errorf("The legacy blob should have been deleted")
+	}
+}
+
+func TestFileAlias(t *testing.T) {
+	st := NewFileStore(t.TempDir())
+	blob := "known by two names"
+
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	alias, err := HashScore("sha512", strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("HashScore returned an error: %v", err)
+	}
+
+	err = st.AddAlias(a.Score, alias)
+	if err != nil {
+		t.Fatalf("st.AddAlias returned an error: %v", err)
+	}
+
+	described, err := st.Describe(alias)
+	if err != nil || described != a {
+		t.Errorf("st.Describe should find the blob by its alias. Expected %+v, got %+v, %v", a, described, err)
+	}
+
+	walked := 0
+	st.Walk(func(a Address) bool {
+		walked++
+		return true
+	})
+	if walked != 1 {
+		t.Errorf("Aliases should not be walked, walked %d blobs", walked)
+	}
+}
+
+func TestFileReplace(t *testing.T) {
+	st := NewFileStore(t.TempDir())
+	blob := "put it back"
+
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	path, _ := resolveFileUri(a.Location)
+	os.Chmod(path, 0644)
+	err = ioutil.WriteFile(path, []byte(blob[:4]), 0644)
+	if err != nil {
+		t.Fatalf("Could not truncate blob: %v", err)
+	}
+
+	err = st.Replace(a, strings.NewReader("something else"))
+	if err != ErrCorrupt {
+		t.Errorf("st.Replace should not write bytes that don't match the score, got %v", err)
+	}
+
+	err = st.Replace(a, strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Replace returned an error: %v", err)
+	}
+
+	err = Verify(st, a)
+	if err != nil {
+		t.Errorf("The blob should have been replaced with a good copy, got %v", err)
+	}
+}
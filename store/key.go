@@ -0,0 +1,108 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyLength  = 32 // AES-256
+	saltLength = 32
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	keyCheck   = "pkrt key check"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("Wrong passphrase") // LoadKeyFile will return this error if the passphrase doesn't match the key file
+)
+
+// keyFile is what is stored in a key file. It has everything needed to derive a key from a passphrase, but not the key itself.
+type keyFile struct {
+	Salt    []byte
+	N, R, P int
+	Check   []byte // HMAC of keyCheck with the key, to tell if a passphrase is wrong
+}
+
+func deriveKey(passphrase string, kf keyFile) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), kf.Salt, kf.N, kf.R, kf.P, keyLength)
+}
+
+func checkValue(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyCheck))
+	return mac.Sum(nil)
+}
+
+// CreateKeyFile makes a new key file at filename for a key derived from passphrase, and returns the key.
+// It will not overwrite an existing key file, since every blob encrypted with the old key would be lost.
+func CreateKeyFile(filename, passphrase string) ([]byte, error) {
+	kf := keyFile{
+		Salt: make([]byte, saltLength),
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+	}
+
+	_, err := rand.Read(kf.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, kf)
+	if err != nil {
+		return nil, err
+	}
+	kf.Check = checkValue(key)
+
+	b, err := json.Marshal(kf)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Write(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, f.Sync()
+}
+
+// LoadKeyFile derives the key for a key file from passphrase.
+func LoadKeyFile(filename, passphrase string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var kf keyFile
+	err = json.Unmarshal(b, &kf)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, kf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(checkValue(key), kf.Check) {
+		return nil, ErrWrongPassphrase
+	}
+
+	return key, nil
+}
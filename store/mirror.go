@@ -0,0 +1,577 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorUriPrefix = "mirror://"
+)
+
+// MirrorStore is a store that keeps a copy of every blob in each of a list of replica stores.
+//
+// Put returns once a quorum of the replicas have the blob. The rest of the replicas finish in the background, and the ones that miss the blob are recorded so Repair can put it back later.
+// The record is kept in memory, or in a file if one is set with SetMissedFile, so it survives a restart.
+// Get and GetAddress read from the first replica that has a good copy of the blob, and put it back into any replica that was missing it or had a bad copy.
+// Addresses from a MirrorStore have a Location of mirror://<score>, which every replica can resolve by its Score.
+type MirrorStore struct {
+	replicas   []Store
+	quorum     int // How many replicas must have a blob for Put to succeed
+	mutex      sync.Mutex
+	missed     map[string]map[int]struct{} // The replicas that Put couldn't write each blob to, by score
+	missedFile string                      // Where missed is kept, or "" to only keep it in memory
+	pending    sync.WaitGroup              // Puts that are still being written to some replicas
+}
+
+// NewMirrorStore returns a MirrorStore of replicas. If quorum is not between 1 and the number of replicas, every replica must succeed.
+func NewMirrorStore(quorum int, replicas ...Store) *MirrorStore {
+	if quorum < 1 || quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+
+	return &MirrorStore{
+		replicas: replicas,
+		quorum:   quorum,
+		missed:   make(map[string]map[int]struct{}),
+	}
+}
+
+// SetMissedFile keeps the record of the replicas that missed blobs in filename, and reads the record a previous MirrorStore left there
+func (s *MirrorStore) SetMissedFile(filename string) *MirrorStore {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.missedFile = filename
+
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s
+	}
+	if err != nil {
+		log.Printf("Could not read the replicas that missed blobs from %q: %v", filename, err)
+		return s
+	}
+
+	var missed map[string][]int
+	err = json.Unmarshal(b, &missed)
+	if err != nil {
+		log.Printf("Could not read the replicas that missed blobs from %q: %v", filename, err)
+		return s
+	}
+
+	for score, replicas := range missed {
+		for _, n := range replicas {
+			if n < 0 || n >= len(s.replicas) {
+				continue
+			}
+			if s.missed[score] == nil {
+				s.missed[score] = make(map[int]struct{})
+			}
+			s.missed[score][n] = struct{}{}
+		}
+	}
+
+	return s
+}
+
+// saveMissed writes the record of the replicas that missed blobs to the missed file, if there is one. The caller must hold the mutex.
+func (s *MirrorStore) saveMissed() {
+	if s.missedFile == "" {
+		return
+	}
+
+	missed := make(map[string][]int, len(s.missed))
+	for score, replicas := range s.missed {
+		for n := range replicas {
+			missed[score] = append(missed[score], n)
+		}
+	}
+
+	b, err := json.Marshal(missed)
+	if err == nil {
+		err = writeFileAtomic(s.missedFile, b)
+	}
+	if err != nil {
+		log.Printf("Could not save the replicas that missed blobs to %q: %v", s.missedFile, err)
+	}
+}
+
+// writeFileAtomic replaces filename with b, so a crash leaves either the old file or the new one
+func writeFileAtomic(filename string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".pkrt-staging")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = tmp.Write(b)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// detachedContext has the values of a context, but is never cancelled and has no deadline.
+// Replicas write on it so the ones that are still writing when Put returns can finish.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func mirrorAddress(a Address) Address {
+	return Address{
+		Score:    a.Score,
+		Location: mirrorUriPrefix + a.Score,
+		Size:     a.Size,
+	}
+}
+
+type mirrorPutResult struct {
+	replica int
+	address Address
+	err     error
+}
+
+func (s *MirrorStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+// PutContext returns ctx's error if ctx is done before a quorum of the replicas have the blob.
+// The replicas keep writing in the background either way, since ctx is for the caller and not the replicas.
+func (s *MirrorStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	var a Address
+
+	// Stage the blob so each replica can read it
+	tmp, err := ioutil.TempFile("", "pkrt-staging")
+	if err != nil {
+		return a, err
+	}
+	defer tmp.Close()
+
+	h := newScoreHash()
+	_, err = io.Copy(io.MultiWriter(tmp, h), contextReader{ctx, r})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return a, err
+	}
+	score := FormatScore(DefaultHash, h.Sum(nil))
+
+	results := make(chan mirrorPutResult, len(s.replicas))
+	for n, replica := range s.replicas {
+		go func(n int, st Store) {
+			result := mirrorPutResult{replica: n}
+			f, err := os.Open(tmp.Name())
+			if err != nil {
+				result.err = err
+				results <- result
+				return
+			}
+			defer f.Close()
+
+			result.address, result.err = withContext(st).PutContext(detachedContext{ctx}, f)
+			results <- result
+		}(n, replica)
+	}
+
+	succeeded := 0
+	waiting := len(s.replicas)
+	missed := make([]int, 0)
+	errs := make([]string, 0)
+	for succeeded < s.quorum && waiting > 0 {
+		var result mirrorPutResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			// The Put failed, so the replicas that miss the blob don't need it
+			s.finishPut(score, tmp.Name(), results, waiting, false)
+			return a, ctx.Err()
+		}
+		waiting--
+
+		err := putResultError(score, result)
+		if err != nil {
+			missed = append(missed, result.replica)
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		a = result.address
+		succeeded++
+	}
+
+	if succeeded < s.quorum {
+		os.Remove(tmp.Name())
+		return a, fmt.Errorf("Blob was only stored in %d of %d replicas: %s", succeeded, s.quorum, strings.Join(errs, "; "))
+	}
+
+	for _, n := range missed {
+		s.recordMissed(score, n)
+	}
+
+	s.finishPut(score, tmp.Name(), results, waiting, true)
+	return mirrorAddress(a), nil
+}
+
+// finishPut waits in the background for the replicas that are still writing a blob, and then removes its staging file.
+// If record is true, the replicas that miss the blob are recorded for Repair.
+func (s *MirrorStore) finishPut(score, tmp string, results chan mirrorPutResult, waiting int, record bool) {
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		for ; waiting > 0; waiting-- {
+			result := <-results
+			err := putResultError(score, result)
+			if err != nil && record {
+				log.Printf("Could not write blob %q to a replica, Repair will put it back: %v", score, err)
+				s.recordMissed(score, result.replica)
+			}
+		}
+		os.Remove(tmp)
+	}()
+}
+
+// putResultError returns the error from putting the blob with score into a replica, or an error if the replica stored some other blob
+func putResultError(score string, result mirrorPutResult) error {
+	if result.err == nil && !SameBlob(result.address.Score, score) {
+		return fmt.Errorf("Replica stored blob %q as %q", score, result.address.Score)
+	}
+	return result.err
+}
+
+// recordMissed records that a replica doesn't have the blob with score
+func (s *MirrorStore) recordMissed(score string, replica int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.missed[score] == nil {
+		s.missed[score] = make(map[int]struct{})
+	}
+	s.missed[score][replica] = struct{}{}
+	s.saveMissed()
+}
+
+// Wait waits for the replicas that Puts are still writing to in the background, so the ones that miss a blob are recorded before the program exits
+func (s *MirrorStore) Wait() {
+	s.pending.Wait()
+}
+
+// Repair puts the blobs that Put couldn't write to every replica into the replicas that missed them.
+// It waits for Puts that are still being written. Blobs that still can't be put back are kept for the next Repair.
+func (s *MirrorStore) Repair() error {
+	s.pending.Wait()
+
+	s.mutex.Lock()
+	missed := s.missed
+	s.missed = make(map[string]map[int]struct{})
+	s.saveMissed()
+	s.mutex.Unlock()
+
+	failed := 0
+	for score, replicas := range missed {
+		err := s.repairMissed(context.Background(), score, replicas)
+		if err != nil {
+			log.Printf("Could not repair blob %q: %v", score, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d blobs could not be repaired", failed)
+	}
+	return nil
+}
+
+// repairMissed copies a good copy of the blob with score into the replicas that missed it. Replicas that still miss it are recorded again.
+func (s *MirrorStore) repairMissed(ctx context.Context, score string, replicas map[int]struct{}) error {
+	tmp, err := ioutil.TempFile("", "pkrt-mirror")
+	if err != nil {
+		for n := range replicas {
+			s.recordMissed(score, n)
+		}
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	found := false
+	for n, replica := range s.replicas {
+		if _, ok := replicas[n]; ok {
+			continue
+		}
+
+		err = s.fetch(ctx, replica, score, tmp)
+		if err == nil {
+			found = true
+			break
+		}
+	}
+
+	var errs []string
+	for n := range replicas {
+		if !found {
+			s.recordMissed(score, n)
+			continue
+		}
+
+		err := s.repair(ctx, s.replicas[n], score, ErrNotExist, tmp)
+		if err != nil {
+			s.recordMissed(score, n)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("No replica has a good copy: %v", err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *MirrorStore) Get(score string, w io.Writer) error {
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *MirrorStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	// Keep the blob in a temp file until it is known to be good, so bad bytes are never written to w
+	tmp, err := ioutil.TempFile("", "pkrt-mirror")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	type badCopy struct {
+		replica Store
+		problem error
+	}
+	bad := make([]badCopy, 0)
+	found := false
+	for _, replica := range s.replicas {
+		err = s.fetch(ctx, replica, score, tmp)
+		if err == nil {
+			found = true
+			break
+		}
+
+		log.Printf("Could not read blob %q from replica: %v", score, err)
+
+		// Only replicas that are known to be missing the blob or have a bad copy are repaired, not ones that couldn't be read
+		if err == ErrNotExist || err == ErrTruncated || err == ErrCorrupt {
+			bad = append(bad, badCopy{replica, err})
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("Blob %q could not be read from any replica: %w", score, err)
+	}
+
+	for _, b := range bad {
+		err = s.repair(ctx, b.replica, score, b.problem, tmp)
+		if err != nil {
+			log.Printf("Could not repair blob %q: %v", score, err)
+		}
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(contextWriter{ctx, w}, tmp)
+	return err
+}
+
+// fetch reads a blob from a replica into tmp and checks that it is good
+func (s *MirrorStore) fetch(ctx context.Context, replica Store, score string, tmp *os.File) error {
+	err := tmp.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	a, err := withContext(replica).DescribeContext(ctx, score)
+	if isNotExist(err) {
+		return ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+
+	return VerifiedCopyContext(ctx, replica, a, tmp)
+}
+
+// repair puts the good copy of a blob in tmp into a replica that is missing it, or writes it over a bad copy.
+// The bad copy is never deleted first, so the replica always has some copy of the blob.
+func (s *MirrorStore) repair(ctx context.Context, replica Store, score string, problem error, tmp *os.File) error {
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if problem == ErrNotExist {
+		a, err := withContext(replica).PutContext(ctx, f)
+		if err != nil {
+			return err
+		}
+		if !SameBlob(a.Score, score) {
+			return fmt.Errorf("Replica stored blob %q as %q", score, a.Score)
+		}
+		return nil
+	}
+
+	replacer, ok := replica.(Replacer)
+	if !ok {
+		return fmt.Errorf("Replica can't replace its bad copy: %v", problem)
+	}
+
+	a, err := withContext(replica).DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	return replaceContext(ctx, replacer, a, f)
+}
+
+func (s *MirrorStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *MirrorStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	return s.GetContext(ctx, a.Score, w)
+}
+
+func (s *MirrorStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *MirrorStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	n, err := clampRange(a, off, n)
+	if err != nil {
+		return err
+	}
+
+	// A range can't be checked against the score, so use the first replica that has the blob
+	for _, replica := range s.replicas {
+		var ra Address
+		ra, err = withContext(replica).DescribeContext(ctx, a.Score)
+		if err != nil {
+			continue
+		}
+
+		return withContext(replica).GetRangeContext(ctx, ra, off, n, w)
+	}
+
+	return fmt.Errorf("Blob %q could not be read from any replica: %v", a.Score, err)
+}
+
+func (s *MirrorStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
+
+func (s *MirrorStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	for _, replica := range s.replicas {
+		a, err := withContext(replica).DescribeContext(ctx, score)
+		if err == nil {
+			return mirrorAddress(a), nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Address{Score: score}, err
+	}
+
+	return Address{Score: score}, ErrNotExist
+}
+
+// Delete removes a blob from every replica that has it
+func (s *MirrorStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *MirrorStore) DeleteContext(ctx context.Context, score string) error {
+	deleted := 0
+	errs := make([]string, 0)
+	for _, replica := range s.replicas {
+		_, err := withContext(replica).DescribeContext(ctx, score)
+		if err != nil {
+			continue
+		}
+
+		err = withContext(replica).DeleteContext(ctx, score)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		deleted++
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Blob could not be deleted from every replica: %s", strings.Join(errs, "; "))
+	}
+
+	if deleted == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return ErrNotExist
+	}
+
+	return nil
+}
+
+// Walk lists the blobs in every replica, skipping blobs that an earlier replica had
+func (s *MirrorStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *MirrorStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	seen := make(map[string]struct{})
+	stopped := false
+	for _, replica := range s.replicas {
+		err := withContext(replica).WalkContext(ctx, func(a Address) bool {
+			if _, ok := seen[CanonicalScore(a.Score)]; ok {
+				return true
+			}
+			seen[CanonicalScore(a.Score)] = struct{}{}
+
+			stopped = !fn(mirrorAddress(a))
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+
+		if stopped {
+			return nil
+		}
+	}
+
+	return nil
+}
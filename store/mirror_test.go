@@ -0,0 +1,264 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) ContextStore {
+		return NewMirrorStore(0, NewFileStore(t.TempDir()), NewPackStore(NewFileStore(t.TempDir()), DefaultMaxPackSize))
+	})
+}
+
+func TestMirrorFallback(t *testing.T) {
+	first := NewFileStore(t.TempDir())
+	second := NewFileStore(t.TempDir())
+	st := NewMirrorStore(0, first, second)
+
+	blob := "one copy is none copy"
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	if a.Location != "mirror://"+a.Score {
+		t.Errorf("Location should be resolvable by any replica, got %q", a.Location)
+	}
+
+	// Lose the first copy
+	firstA, err := first.Describe(a.Score)
+	if err != nil {
+		t.Fatalf("The first replica should have the blob: %v", err)
+	}
+	path, _ := resolveFileUri(firstA.Location)
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatalf("Could not remove blob: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = st.GetAddress(a, &buf)
+	if err != nil {
+		t.Errorf("st.GetAddress should have fallen back to the second replica, got %v", err)
+	}
+
+	if buf.String() != blob {
+		t.Errorf("st.GetAddress returned the wrong bytes. Expected %q, got %q", blob, buf.String())
+	}
+
+	err = Verify(first, firstA)
+	if err != nil {
+		t.Errorf("The first replica should have been repaired, got %v", err)
+	}
+}
+
+func TestMirrorRepairCorrupt(t *testing.T) {
+	first := NewFileStore(t.TempDir())
+	second := NewFileStore(t.TempDir())
+	st := NewMirrorStore(0, first, second)
+
+	blob := "bit rot happens"
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	firstA, err := first.Describe(a.Score)
+	if err != nil {
+		t.Fatalf("The first replica should have the blob: %v", err)
+	}
+	path, _ := resolveFileUri(firstA.Location)
+	os.Chmod(path, 0644)
+	err = ioutil.WriteFile(path, []byte(strings.ToUpper(blob)), 0644)
+	if err != nil {
+		t.Fatalf("Could not corrupt blob: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = st.Get(a.Score, &buf)
+	if err != nil {
+		t.Errorf("st.Get should have fallen back to the second replica, got %v", err)
+	}
+
+	if buf.String() != blob {
+		t.Errorf("st.Get returned the wrong bytes. Expected %q, got %q", blob, buf.String())
+	}
+
+	err = Verify(first, firstA)
+	if err != nil {
+		t.Errorf("The corrupt copy should have been repaired, got %v", err)
+	}
+}
+
+func TestMirrorQuorum(t *testing.T) {
+	good := NewFileStore(t.TempDir())
+
+	// A store whose root is a file can't be written to
+	broken, err := ioutil.TempFile(t.TempDir(), "broken")
+	if err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	broken.Close()
+	bad := NewFileStore(broken.Name())
+
+	_, err = NewMirrorStore(2, good, bad).Put(strings.NewReader("need two"))
+	if err == nil {
+		t.Errorf("Put should have failed without a quorum")
+	}
+
+	st := NewMirrorStore(1, good, bad)
+	a, err := st.Put(strings.NewReader("need one"))
+	if err != nil {
+		t.Errorf("Put should have succeeded with a quorum, got %v", err)
+	}
+
+	err = st.Repair()
+	if err == nil {
+		t.Errorf("Repair should have failed while a replica is broken")
+	}
+
+	// Fix the broken replica, so Repair can put back the blob it missed
+	err = os.Remove(broken.Name())
+	if err != nil {
+		t.Fatalf("Could not remove file: %v", err)
+	}
+
+	err = st.Repair()
+	if err != nil {
+		t.Errorf("Repair returned an error: %v", err)
+	}
+
+	_, err = bad.Describe(a.Score)
+	if err != nil {
+		t.Errorf("Repair should have put the blob in the replica that missed it, got %v", err)
+	}
+
+	err = st.Repair()
+	if err != nil {
+		t.Errorf("Repair should have had nothing left to do, got %v", err)
+	}
+}
+
+func TestMirrorMissedFile(t *testing.T) {
+	good := NewFileStore(t.TempDir())
+	missedFile := filepath.Join(t.TempDir(), "missed.json")
+
+	broken, err := ioutil.TempFile(t.TempDir(), "broken")
+	if err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	broken.Close()
+	bad := NewFileStore(broken.Name())
+
+	st := NewMirrorStore(1, good, bad).SetMissedFile(missedFile)
+	a, err := st.Put(strings.NewReader("remember me"))
+	if err != nil {
+		t.Fatalf("Put should have succeeded with a quorum, got %v", err)
+	}
+	st.Wait()
+
+	err = os.Remove(broken.Name())
+	if err != nil {
+		t.Fatalf("Could not remove file: %v", err)
+	}
+
+	// A new MirrorStore, like the next run of a program, repairs the blob the first one missed
+	err = NewMirrorStore(1, good, bad).SetMissedFile(missedFile).Repair()
+	if err != nil {
+		t.Errorf("Repair returned an error: %v", err)
+	}
+
+	_, err = bad.Describe(a.Score)
+	if err != nil {
+		t.Errorf("Repair should have put the blob in the replica that missed it, got %v", err)
+	}
+
+	st = NewMirrorStore(1, good, bad).SetMissedFile(missedFile)
+	if len(st.missed) != 0 {
+		t.Errorf("The repaired blob should have been dropped from the missed file, got %v", st.missed)
+	}
+}
+
+// slowStore is a replica that takes a while to write blobs
+type slowStore struct {
+	ContextStore
+}
+
+func (s slowStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	time.Sleep(50 * time.Millisecond)
+	return s.ContextStore.PutContext(ctx, r)
+}
+
+func TestMirrorDetachedWrites(t *testing.T) {
+	fast := NewFileStore(t.TempDir())
+	slow := NewFileStore(t.TempDir())
+	st := NewMirrorStore(1, fast, slowStore{slow})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a, err := st.PutContext(ctx, strings.NewReader("finish what you started"))
+	if err != nil {
+		t.Fatalf("PutContext returned an error: %v", err)
+	}
+
+	// The caller is done with ctx once Put returns, but the slow replica still gets the blob
+	cancel()
+	st.Wait()
+
+	_, err = slow.Describe(a.Score)
+	if err != nil {
+		t.Errorf("The slow replica should have the blob, got %v", err)
+	}
+
+	if len(st.missed) != 0 {
+		t.Errorf("No replica should have missed the blob, got %v", st.missed)
+	}
+}
+
+// flakyStore is a replica that can't be reached, and counts the blobs that are put in it
+type flakyStore struct {
+	Store
+	puts int
+}
+
+func (s *flakyStore) Describe(score string) (Address, error) {
+	return Address{Score: score}, errors.New("connection reset by peer")
+}
+
+func (s *flakyStore) Put(r io.Reader) (Address, error) {
+	s.puts++
+	return s.Store.Put(r)
+}
+
+func TestMirrorUnreachable(t *testing.T) {
+	flaky := &flakyStore{Store: NewFileStore(t.TempDir())}
+	good := NewFileStore(t.TempDir())
+
+	blob := "try again later"
+	a, err := good.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("good.Put returned an error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = NewMirrorStore(0, flaky, good).Get(a.Score, &buf)
+	if err != nil {
+		t.Errorf("st.Get should have fallen back to the second replica, got %v", err)
+	}
+
+	if buf.String() != blob {
+		t.Errorf("st.Get returned the wrong bytes. Expected %q, got %q", blob, buf.String())
+	}
+
+	if flaky.puts != 0 {
+		t.Errorf("A replica that couldn't be reached should not be repaired, got %d puts", flaky.puts)
+	}
+}
@@ -0,0 +1,507 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	packUriPrefix      = "pack://"
+	DefaultMaxPackSize = 64 << 20 // Packs are closed once they grow past this many bytes
+)
+
+// PackStore is a store that appends small blobs, like thumbnails, to large packs and keeps the packs in another store.
+//
+// Blobs are appended to an open pack in a temporary file. Once the open pack grows past the maximum size, or Flush is called,
+// it is put in the underlying store along with a record of the score, offset and size of every blob in it.
+// Blobs in the open pack are lost if the process exits before the pack is flushed, so flush before writing their Addresses anywhere that outlives the process, like an index.
+//
+// Records are blobs in the underlying store too. They are numbered, and found by an alias made from their number, so the underlying store must be an Aliaser.
+// Deleting a blob from a closed pack puts a record that says the blob was deleted. The blob's bytes stay in the pack.
+//
+// A blob's Address has a Location of pack://<number of its pack>, and the Offset and Size of the blob inside of it.
+// GetAddress and GetRange read just the blob's part of its pack from the underlying store.
+//
+// Only one PackStore should write to an underlying store at a time.
+type PackStore struct {
+	st          Store
+	maxPackSize int64
+	mutex       sync.Mutex
+	addresses   map[string]Address // Every blob in the store, loaded from the records on first use
+	packs       map[int]Address    // The Address of every closed pack in the underlying store
+	records     int                // The number of records in the underlying store
+	nextPack    int                // The number of the open pack
+	open        *os.File           // The open pack, or nil if nothing has been put since the last one was closed
+	openSize    int64
+	openBlobs   []string // The scores of the blobs in the open pack, in order
+}
+
+func NewPackStore(st Store, maxPackSize int64) *PackStore {
+	return &PackStore{
+		st:          st,
+		maxPackSize: maxPackSize,
+	}
+}
+
+func packLocation(n int) string {
+	return fmt.Sprintf("%s%08d", packUriPrefix, n)
+}
+
+func resolvePackUri(uri string) (int, error) {
+	var n int
+	if !strings.HasPrefix(uri, packUriPrefix) {
+		return n, fmt.Errorf("Invalid pack uri: %q", uri)
+	}
+
+	_, err := fmt.Sscanf(uri[len(packUriPrefix):], "%d", &n)
+	if err != nil {
+		return n, fmt.Errorf("Invalid pack uri: %q", uri)
+	}
+
+	return n, nil
+}
+
+// recordAlias is the score that record n can be found by in the underlying store
+func recordAlias(n int) string {
+	h := newScoreHash()
+	fmt.Fprintf(h, "packrat pack record %d", n)
+	return FormatScore(DefaultHash, h.Sum(nil))
+}
+
+// load reads the records from the underlying store. The caller must hold the mutex.
+func (s *PackStore) load(ctx context.Context) error {
+	if s.addresses != nil {
+		return nil
+	}
+
+	addresses := make(map[string]Address)
+	packs := make(map[int]Address)
+	records := 0
+	for {
+		a, err := withContext(s.st).DescribeContext(ctx, recordAlias(records+1))
+		if isNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		err = withContext(s.st).GetAddressContext(ctx, a, &buf)
+		if err != nil {
+			return err
+		}
+
+		err = readPackRecord(&buf, addresses, packs)
+		if err != nil {
+			return fmt.Errorf("Invalid pack record %d: %v", records+1, err)
+		}
+		records++
+	}
+
+	s.nextPack = 1
+	for n := range packs {
+		if n >= s.nextPack {
+			s.nextPack = n + 1
+		}
+	}
+
+	s.addresses = addresses
+	s.packs = packs
+	s.records = records
+	return nil
+}
+
+// readPackRecord applies the lines of a record to addresses and packs.
+//
+// A record that closes a pack has a line of "pack <number> <score> <size>", followed by a line of "blob <score> <offset> <size>" for every blob in the pack.
+// A record that deletes a blob has a line of "delete <score>".
+func readPackRecord(r io.Reader, addresses map[string]Address, packs map[int]Address) error {
+	pack := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "pack":
+			var a Address
+			_, err := fmt.Sscanf(scanner.Text(), "pack %d %s %d", &pack, &a.Score, &a.Size)
+			if err != nil {
+				return err
+			}
+			packs[pack] = a
+		case "blob":
+			if pack == 0 {
+				return fmt.Errorf("Blob before its pack: %q", scanner.Text())
+			}
+
+			a := Address{Location: packLocation(pack)}
+			_, err := fmt.Sscanf(scanner.Text(), "blob %s %d %d", &a.Score, &a.Offset, &a.Size)
+			if err != nil {
+				return err
+			}
+			addresses[a.Score] = a
+		case "delete":
+			if len(fields) != 2 {
+				return fmt.Errorf("Invalid line: %q", scanner.Text())
+			}
+			delete(addresses, fields[1])
+		default:
+			return fmt.Errorf("Invalid line: %q", scanner.Text())
+		}
+	}
+
+	return scanner.Err()
+}
+
+// putRecord puts a record in the underlying store and aliases it with the next record number. The caller must hold the mutex.
+func (s *PackStore) putRecord(ctx context.Context, record string) error {
+	aliaser, ok := s.st.(Aliaser)
+	if !ok {
+		return ErrNoAliases
+	}
+
+	a, err := withContext(s.st).PutContext(ctx, strings.NewReader(record))
+	if err != nil {
+		return err
+	}
+
+	err = addAliasContext(ctx, aliaser, a.Score, recordAlias(s.records+1))
+	if err != nil {
+		return err
+	}
+
+	s.records++
+	return nil
+}
+
+// appendBlob appends the staged blob in tmp to the open pack. The caller must hold the mutex.
+func (s *PackStore) appendBlob(ctx context.Context, a Address, tmp *os.File) (Address, error) {
+	if s.open == nil {
+		open, err := ioutil.TempFile("", "pkrt-pack")
+		if err != nil {
+			return a, err
+		}
+		s.open = open
+		s.openSize = 0
+	}
+
+	// Bytes left over from a failed write are never recorded, so they are written over
+	_, err := s.open.Seek(s.openSize, io.SeekStart)
+	if err != nil {
+		return a, err
+	}
+
+	copied, err := io.Copy(s.open, tmp)
+	if err != nil {
+		return a, err
+	}
+
+	a.Location = packLocation(s.nextPack)
+	a.Offset = s.openSize
+
+	s.openSize += copied
+	s.openBlobs = append(s.openBlobs, a.Score)
+	s.addresses[a.Score] = a
+
+	if s.openSize >= s.maxPackSize {
+		return a, s.closePack(ctx)
+	}
+
+	return a, nil
+}
+
+// closePack puts the open pack and its record in the underlying store. The caller must hold the mutex.
+func (s *PackStore) closePack(ctx context.Context) error {
+	if s.open == nil {
+		return nil
+	}
+
+	location := packLocation(s.nextPack)
+	var record strings.Builder
+	for _, score := range s.openBlobs {
+		// Blobs deleted from the open pack aren't recorded
+		if a, ok := s.addresses[score]; ok && a.Location == location {
+			fmt.Fprintf(&record, "blob %s %d %d\n", a.Score, a.Offset, a.Size)
+		}
+	}
+
+	if record.Len() > 0 {
+		_, err := s.open.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		pack, err := withContext(s.st).PutContext(ctx, io.LimitReader(s.open, s.openSize))
+		if err != nil {
+			return err
+		}
+		if pack.Size != s.openSize {
+			return ErrTruncated
+		}
+
+		err = s.putRecord(ctx, fmt.Sprintf("pack %d %s %d\n", s.nextPack, pack.Score, pack.Size)+record.String())
+		if err != nil {
+			return err
+		}
+
+		s.packs[s.nextPack] = pack
+		s.nextPack++
+	}
+
+	s.open.Close()
+	os.Remove(s.open.Name())
+	s.open = nil
+	s.openSize = 0
+	s.openBlobs = nil
+
+	return nil
+}
+
+// Flush closes the open pack, so every blob that has been put is in the underlying store
+func (s *PackStore) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ctx := context.Background()
+	err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.closePack(ctx)
+}
+
+func (s *PackStore) Put(r io.Reader) (Address, error) {
+	return s.PutContext(context.Background(), r)
+}
+
+func (s *PackStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	var a Address
+
+	// Stage the blob so it can be hashed before it is added to a pack
+	tmp, err := ioutil.TempFile("", "pkrt-staging")
+	if err != nil {
+		return a, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := newScoreHash()
+	length, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx, r})
+	a.Size = length
+	if err != nil {
+		return a, err
+	}
+
+	a.Score = FormatScore(DefaultHash, h.Sum(nil))
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return a, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err = s.load(ctx)
+	if err != nil {
+		return a, err
+	}
+
+	// If the blob is already in a pack, return its Address
+	if existing, ok := s.lookup(a.Score); ok {
+		return existing, nil
+	}
+
+	return s.appendBlob(ctx, a, tmp)
+}
+
+func (s *PackStore) Get(score string, w io.Writer) error {
+	return s.GetContext(context.Background(), score, w)
+}
+
+func (s *PackStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	addr, err := s.DescribeContext(ctx, score)
+	if err != nil {
+		return err
+	}
+
+	return s.GetAddressContext(ctx, addr, w)
+}
+
+func (s *PackStore) GetAddress(a Address, w io.Writer) error {
+	return s.GetAddressContext(context.Background(), a, w)
+}
+
+func (s *PackStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	return s.GetRangeContext(ctx, a, 0, a.Size, w)
+}
+
+// GetRange reads the range from the open pack if the blob is in it, and otherwise with a ranged read of its pack in the underlying store
+func (s *PackStore) GetRange(a Address, off, n int64, w io.Writer) error {
+	return s.GetRangeContext(context.Background(), a, off, n, w)
+}
+
+func (s *PackStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	n, err := clampRange(a, off, n)
+	if err != nil {
+		return err
+	}
+
+	number, err := resolvePackUri(a.Location)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	err = s.load(ctx)
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+
+	c := &countingWriter{}
+	if number == s.nextPack && s.open != nil {
+		_, err = io.Copy(contextWriter{ctx, io.MultiWriter(w, c)}, io.NewSectionReader(s.open, a.Offset+off, n))
+		s.mutex.Unlock()
+	} else {
+		pack, ok := s.packs[number]
+		s.mutex.Unlock()
+		if !ok {
+			return ErrNotExist
+		}
+
+		err = s.getPackRange(ctx, number, pack, a.Offset+off, n, io.MultiWriter(w, c))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if c.n != n {
+		return ErrTruncated
+	}
+
+	return nil
+}
+
+// getPackRange reads n bytes of closed pack number, starting off bytes into the pack
+func (s *PackStore) getPackRange(ctx context.Context, number int, pack Address, off, n int64, w io.Writer) error {
+	// Packs loaded from records only have a score, so look up where they are the first time they are read
+	if pack.Location == "" {
+		described, err := withContext(s.st).DescribeContext(ctx, pack.Score)
+		if err != nil {
+			return err
+		}
+		pack = described
+
+		s.mutex.Lock()
+		s.packs[number] = pack
+		s.mutex.Unlock()
+	}
+
+	return withContext(s.st).GetRangeContext(ctx, pack, off, n, w)
+}
+
+// lookup finds a blob under any spelling of its score. The caller must hold the mutex.
+func (s *PackStore) lookup(score string) (Address, bool) {
+	for _, spelling := range scoreSpellings(score) {
+		if a, ok := s.addresses[spelling]; ok {
+			return a, true
+		}
+	}
+	return Address{}, false
+}
+
+func (s *PackStore) Describe(score string) (Address, error) {
+	return s.DescribeContext(context.Background(), score)
+}
+
+func (s *PackStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.load(ctx)
+	if err != nil {
+		return Address{Score: score}, err
+	}
+
+	a, ok := s.lookup(score)
+	if !ok {
+		return Address{Score: score}, ErrNotExist
+	}
+
+	return a, nil
+}
+
+func (s *PackStore) Delete(score string) error {
+	return s.DeleteContext(context.Background(), score)
+}
+
+func (s *PackStore) DeleteContext(ctx context.Context, score string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	a, ok := s.lookup(score)
+	if !ok {
+		return ErrNotExist
+	}
+
+	// Blobs in the open pack are just left out of its record
+	if a.Location != packLocation(s.nextPack) || s.open == nil {
+		err = s.putRecord(ctx, fmt.Sprintf("delete %s\n", a.Score))
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(s.addresses, a.Score)
+	return nil
+}
+
+func (s *PackStore) Walk(fn func(a Address) bool) error {
+	return s.WalkContext(context.Background(), fn)
+}
+
+func (s *PackStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	// Copy the addresses so fn can use the store
+	s.mutex.Lock()
+	err := s.load(ctx)
+	addresses := make([]Address, 0, len(s.addresses))
+	for _, a := range s.addresses {
+		addresses = append(addresses, a)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, a := range addresses {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !fn(a) {
+			return nil
+		}
+	}
+
+	return nil
+}
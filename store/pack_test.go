@@ -0,0 +1,130 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newTestPackStore(t *testing.T, maxPackSize int64) (*PackStore, *FileStore) {
+	underlying := NewFileStore(t.TempDir())
+	return NewPackStore(underlying, maxPackSize), underlying
+}
+
+func TestPackConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) ContextStore {
+		st, _ := newTestPackStore(t, DefaultMaxPackSize)
+		return st
+	})
+}
+
+func TestPackDeleteReload(t *testing.T) {
+	st, underlying := newTestPackStore(t, DefaultMaxPackSize)
+
+	a, err := st.Put(strings.NewReader("gone for good"))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	err = st.Flush()
+	if err != nil {
+		t.Fatalf("st.Flush returned an error: %v", err)
+	}
+
+	err = st.Delete(a.Score)
+	if err != nil {
+		t.Fatalf("st.Delete returned an error: %v", err)
+	}
+
+	_, err = NewPackStore(underlying, DefaultMaxPackSize).Describe(a.Score)
+	if err != ErrNotExist {
+		t.Errorf("A new store on the same underlying store should not find a deleted blob, got %v", err)
+	}
+}
+
+func TestPackOffsets(t *testing.T) {
+	st, underlying := newTestPackStore(t, 64)
+
+	addresses := make([]Address, 0)
+	for n := 0; n < 10; n++ {
+		a, err := st.Put(strings.NewReader(fmt.Sprintf("thumbnail number %d", n)))
+		if err != nil {
+			t.Fatalf("st.Put returned an error: %v", err)
+		}
+		addresses = append(addresses, a)
+	}
+
+	if addresses[1].Location != addresses[0].Location || addresses[1].Offset != addresses[0].Size {
+		t.Errorf("The second blob should follow the first in the same pack, got %+v and %+v", addresses[0], addresses[1])
+	}
+
+	if addresses[9].Location == addresses[0].Location {
+		t.Errorf("Packs should roll over once they are bigger than the maximum size")
+	}
+
+	err := st.Flush()
+	if err != nil {
+		t.Fatalf("st.Flush returned an error: %v", err)
+	}
+
+	// The packs are blobs in the underlying store, so there are a few of them instead of one per thumbnail
+	blobs := 0
+	err = underlying.Walk(func(a Address) bool {
+		blobs++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("underlying.Walk returned an error: %v", err)
+	}
+	if blobs == 0 || blobs >= 2*len(addresses) {
+		t.Errorf("Expected a pack and a record for every few blobs in the underlying store, got %d blobs", blobs)
+	}
+
+	// A new store on the same underlying store should load the records
+	reopened := NewPackStore(underlying, 64)
+	for n, a := range addresses {
+		described, err := reopened.Describe(a.Score)
+		if err != nil {
+			t.Errorf("Describe on a new store returned an error: %v", err)
+		}
+
+		if described != a {
+			t.Errorf("Describe on a new store returned a different address. Expected %+v, got %+v", a, described)
+		}
+
+		var buf bytes.Buffer
+		err = reopened.GetAddress(a, &buf)
+		if err != nil {
+			t.Errorf("GetAddress returned an error: %v", err)
+		}
+
+		expected := fmt.Sprintf("thumbnail number %d", n)
+		if buf.String() != expected {
+			t.Errorf("GetAddress returned the wrong bytes. Expected %q, got %q", expected, buf.String())
+		}
+	}
+
+	a, err := reopened.Put(strings.NewReader("one more"))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	if a.Location == addresses[9].Location || a.Offset != 0 {
+		t.Errorf("A new store should start a new pack, got %+v", a)
+	}
+}
+
+func TestPackNoAliases(t *testing.T) {
+	st := NewPackStore(NewMirrorStore(0, NewFileStore(t.TempDir())), DefaultMaxPackSize)
+
+	_, err := st.Put(strings.NewReader("nowhere to go"))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	err = st.Flush()
+	if err != ErrNoAliases {
+		t.Errorf("Flush should have returned ErrNoAliases for a store without aliases, got %v", err)
+	}
+}
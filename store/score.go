@@ -0,0 +1,147 @@
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultHash is the hash algorithm that stores use to score new blobs
+const DefaultHash = "sha256"
+
+var (
+	ErrUnknownHash  = errors.New("Unknown hash algorithm")         // Scores made with a hash algorithm that hasn't been registered can't be checked
+	ErrHashName     = errors.New("Invalid hash algorithm name")    // RegisterHash will return this error if a name isn't lowercase letters and digits, since it couldn't be parsed back out of a score
+	ErrInvalidScore = errors.New("Invalid score")                  // ParseScore will return this error if a score isn't <algorithm>-<hex digest> or a legacy bare hex digest
+	ErrNoAliases    = errors.New("Store does not support aliases") // Stores that find their blobs by aliases in an underlying store will return this error if it isn't an Aliaser
+	ErrAlias        = errors.New("Score is an alias")              // Delete will return this error for an alias, so deleting by one name doesn't remove a blob that other names point to
+	ErrAliasInUse   = errors.New("Alias names another blob")       // AddAlias will return this error if the alias is already the score or an alias of a different blob
+)
+
+var (
+	hashesMutex sync.RWMutex
+	hashes      = map[string]func() hash.Hash{
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterHash makes a hash algorithm available for scores. Names must be lowercase letters and digits.
+func RegisterHash(name string, fn func() hash.Hash) error {
+	if !isLowerAlnum(name) {
+		return ErrHashName
+	}
+
+	hashesMutex.Lock()
+	defer hashesMutex.Unlock()
+
+	hashes[name] = fn
+	return nil
+}
+
+// NewHash returns a new hash for a registered algorithm
+func NewHash(algorithm string) (hash.Hash, error) {
+	hashesMutex.RLock()
+	defer hashesMutex.RUnlock()
+
+	fn, ok := hashes[algorithm]
+	if !ok {
+		return nil, ErrUnknownHash
+	}
+
+	return fn(), nil
+}
+
+// newScoreHash returns a hash for scoring new blobs
+func newScoreHash() hash.Hash {
+	h, _ := NewHash(DefaultHash)
+	return h
+}
+
+// FormatScore makes a self describing score, like sha256-<hex digest>
+func FormatScore(algorithm string, sum []byte) string {
+	return fmt.Sprintf("%s-%x", algorithm, sum)
+}
+
+// ParseScore splits a score into its algorithm and hex digest. Legacy scores are a bare hex digest, and were made with sha256.
+func ParseScore(score string) (algorithm, digest string, err error) {
+	algorithm, digest = DefaultHash, score
+	if i := strings.IndexByte(score, '-'); i != -1 {
+		algorithm, digest = score[:i], score[i+1:]
+	}
+
+	if !isLowerAlnum(algorithm) || !isHex(digest) {
+		return "", "", ErrInvalidScore
+	}
+
+	return algorithm, digest, nil
+}
+
+func isHex(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789abcdef", r)
+	}) == -1
+}
+
+func isLowerAlnum(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789abcdefghijklmnopqrstuvwxyz", r)
+	}) == -1
+}
+
+// scoreSpellings returns the ways a blob with score could have been stored.
+// Blobs from before scores were self describing are stored under the bare sha256 digest.
+func scoreSpellings(score string) []string {
+	algorithm, digest, err := ParseScore(score)
+	if err != nil || algorithm != "sha256" {
+		return []string{score}
+	}
+
+	if score == digest {
+		return []string{score, algorithm + "-" + digest}
+	}
+	return []string{score, digest}
+}
+
+// CanonicalScore returns the self describing spelling of a score, so legacy bare scores can be compared with new ones
+func CanonicalScore(score string) string {
+	algorithm, digest, err := ParseScore(score)
+	if err != nil {
+		return score
+	}
+	return algorithm + "-" + digest
+}
+
+// SameBlob tells if two scores are spellings of the same score
+func SameBlob(a, b string) bool {
+	return CanonicalScore(a) == CanonicalScore(b)
+}
+
+// HashScore reads r to the end and returns its score with algorithm
+func HashScore(algorithm string, r io.Reader) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatScore(algorithm, h.Sum(nil)), nil
+}
+
+// Aliaser is implemented by stores that can find a blob by more than one score.
+//
+// AddAlias records that the blob with score can also be found with alias, like a score made with a different hash algorithm.
+// Aliases are not walked, and stop working when the blob is deleted. A blob can only be deleted by its own score, not by an alias.
+// Adding an alias again for the same blob is harmless, but an alias can't be moved to another blob.
+type Aliaser interface {
+	AddAlias(score, alias string) error
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestParseScore(t *testing.T) {
+	tests := []struct {
+		score     string
+		algorithm string
+		digest    string
+		valid     bool
+	}{
+		{"sha256-abc123", "sha256", "abc123", true},
+		{"abc123", "sha256", "abc123", true},
+		{"blake3-00ff", "blake3", "00ff", true},
+		{"", "", "", false},
+		{"sha256-", "", "", false},
+		{"-abc123", "", "", false},
+		{"sha256-ABC123", "", "", false},
+		{"../etc-abc", "", "", false},
+	}
+
+	for _, tc := range tests {
+		algorithm, digest, err := ParseScore(tc.score)
+		if tc.valid != (err == nil) {
+			t.Errorf("ParseScore(%q) returned %v", tc.score, err)
+			continue
+		}
+
+		if algorithm != tc.algorithm || digest != tc.digest {
+			t.Errorf("ParseScore(%q) returned %q, %q. Expected %q, %q", tc.score, algorithm, digest, tc.algorithm, tc.digest)
+		}
+	}
+
+	if !SameBlob("abc123", "sha256-abc123") || SameBlob("abc123", "sha512-abc123") {
+		t.Errorf("SameBlob should only match spellings of the same score")
+	}
+}
+
+func TestHashScore(t *testing.T) {
+	blob := []byte("hash me twice")
+
+	s, err := HashScore("sha256", strings.NewReader(string(blob)))
+	if err != nil || s != score(blob) {
+		t.Errorf("HashScore returned %q, %v. Expected %q", s, err, score(blob))
+	}
+
+	s, err = HashScore("sha512", strings.NewReader(string(blob)))
+	if err != nil || !strings.HasPrefix(s, "sha512-") || len(s) != len("sha512-")+128 {
+		t.Errorf("HashScore returned a bad sha512 score: %q, %v", s, err)
+	}
+
+	_, err = HashScore("md4", strings.NewReader(string(blob)))
+	if err != ErrUnknownHash {
+		t.Errorf("HashScore should not know md4, got %v", err)
+	}
+}
+
+func TestRegisterHash(t *testing.T) {
+	for _, name := range []string{"", "SHA256", "sha-256", "sha256/x", "../etc"} {
+		err := RegisterHash(name, sha256.New)
+		if err != ErrHashName {
+			t.Errorf("RegisterHash(%q) should have returned ErrHashName, got %v", name, err)
+		}
+
+		_, err = NewHash(name)
+		if err != ErrUnknownHash {
+			t.Errorf("RegisterHash(%q) should not have registered the hash, got %v", name, err)
+		}
+	}
+
+	err := RegisterHash("sha256again", sha256.New)
+	if err != nil {
+		t.Fatalf("RegisterHash returned an error: %v", err)
+	}
+
+	blob := []byte("hash me again")
+	s, err := HashScore("sha256again", strings.NewReader(string(blob)))
+	if err != nil || !SameBlob(strings.TrimPrefix(s, "sha256again-"), score(blob)) {
+		t.Errorf("HashScore returned %q, %v for a registered hash", s, err)
+	}
+}
@@ -1,7 +1,20 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var (
+	ErrInvalidRange = errors.New("Invalid range")                // GetRange will return this error if the range does not start inside of the blob
+	ErrTruncated    = errors.New("Blob is truncated")            // Reading a blob will return this error if there are fewer bytes in the store than its Size
+	ErrCorrupt      = errors.New("Blob is corrupt")              // Verify will return this error if the bytes in the store don't match the blob's Score
+	ErrNotExist     = errors.New("Blob does not exist in store") // Describe, Get, Delete and Verify will return this error if there is no blob with the score
+	ErrMissing      = ErrNotExist                                // The same error as ErrNotExist, for code that checked what Verify returned before they were one
 )
 
 type Address struct {
@@ -19,10 +32,195 @@ type Address struct {
 //
 // GetAddress writes bytes from the store for Address a to w.
 //
+// GetRange writes n bytes from the store for Address a to w, starting off bytes into the blob. If the range goes past the end of the blob, only the bytes up to the end are written.
+//
 // Describe looks up a blob in the store's index at id and returns the Address of the blob.
+//
+// Delete removes a blob from the store and its index.
+//
+// Walk calls fn with the Address of every blob in the store, in no particular order, until fn returns false.
 type Store interface {
 	Put(r io.Reader) (Address, error)
 	Get(score string, w io.Writer) error
 	GetAddress(a Address, w io.Writer) error
+	GetRange(a Address, off, n int64, w io.Writer) error
 	Describe(score string) (Address, error)
+	Delete(score string) error
+	Walk(fn func(a Address) bool) error
+}
+
+// ContextStore is a Store whose calls can be cancelled, or given a deadline, with a context.Context.
+// Calling a method of Store is the same as calling its Context variant with context.Background().
+type ContextStore interface {
+	Store
+	PutContext(ctx context.Context, r io.Reader) (Address, error)
+	GetContext(ctx context.Context, score string, w io.Writer) error
+	GetAddressContext(ctx context.Context, a Address, w io.Writer) error
+	GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error
+	DescribeContext(ctx context.Context, score string) (Address, error)
+	DeleteContext(ctx context.Context, score string) error
+	WalkContext(ctx context.Context, fn func(a Address) bool) error
+}
+
+// Flusher is implemented by stores that hold on to blobs for a while before they write them to another store, like PackStore.
+// Flush writes every blob that has been put.
+type Flusher interface {
+	Flush() error
+}
+
+// Replacer is implemented by stores that can write over a blob they already have.
+//
+// Replace writes the bytes from r over the blob at Address a, so a good copy can be put back in place of a corrupt or truncated one.
+// The bytes must hash to a.Score, or Replace returns ErrCorrupt and leaves the blob alone.
+type Replacer interface {
+	Replace(a Address, r io.Reader) error
+}
+
+// clampRange checks that a range starts inside of a blob and shortens it to end at the end of the blob
+func clampRange(a Address, off, n int64) (int64, error) {
+	if off < 0 || n < 0 || off > a.Size {
+		return 0, ErrInvalidRange
+	}
+
+	if off+n > a.Size {
+		n = a.Size - off
+	}
+
+	return n, nil
+}
+
+// isNotExist tells if err means that a blob isn't in a store, rather than that the store couldn't be read
+func isNotExist(err error) bool {
+	if errors.Is(err, ErrNotExist) || os.IsNotExist(err) {
+		return true
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+
+	return false
+}
+
+// contextReader stops reading once its context is done, so long copies from a store that doesn't take a context can still be cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter stops writing once its context is done
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// withContext returns st as a ContextStore. Stores that don't take a context check it before each call and while they copy bytes.
+func withContext(st Store) ContextStore {
+	if cst, ok := st.(ContextStore); ok {
+		return cst
+	}
+	return backgroundStore{st}
+}
+
+// backgroundStore is a Store that doesn't take a context, wrapped up as a ContextStore
+type backgroundStore struct {
+	Store
+}
+
+func (s backgroundStore) PutContext(ctx context.Context, r io.Reader) (Address, error) {
+	if err := ctx.Err(); err != nil {
+		return Address{}, err
+	}
+	return s.Put(contextReader{ctx, r})
+}
+
+func (s backgroundStore) GetContext(ctx context.Context, score string, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Get(score, contextWriter{ctx, w})
+}
+
+func (s backgroundStore) GetAddressContext(ctx context.Context, a Address, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.GetAddress(a, contextWriter{ctx, w})
+}
+
+func (s backgroundStore) GetRangeContext(ctx context.Context, a Address, off, n int64, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.GetRange(a, off, n, contextWriter{ctx, w})
+}
+
+func (s backgroundStore) DescribeContext(ctx context.Context, score string) (Address, error) {
+	if err := ctx.Err(); err != nil {
+		return Address{Score: score}, err
+	}
+	return s.Describe(score)
+}
+
+func (s backgroundStore) DeleteContext(ctx context.Context, score string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(score)
+}
+
+func (s backgroundStore) WalkContext(ctx context.Context, fn func(a Address) bool) error {
+	err := s.Walk(func(a Address) bool {
+		return ctx.Err() == nil && fn(a)
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// addAliasContext adds an alias to an Aliaser, with ctx if it takes one
+func addAliasContext(ctx context.Context, aliaser Aliaser, score, alias string) error {
+	if cst, ok := aliaser.(interface {
+		AddAliasContext(ctx context.Context, score, alias string) error
+	}); ok {
+		return cst.AddAliasContext(ctx, score, alias)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return aliaser.AddAlias(score, alias)
+}
+
+// replaceContext writes over a blob in a Replacer, with ctx if it takes one
+func replaceContext(ctx context.Context, replacer Replacer, a Address, r io.Reader) error {
+	if cst, ok := replacer.(interface {
+		ReplaceContext(ctx context.Context, a Address, r io.Reader) error
+	}); ok {
+		return cst.ReplaceContext(ctx, a, r)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return replacer.Replace(a, contextReader{ctx, r})
 }
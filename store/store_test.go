@@ -0,0 +1,359 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func score(b []byte) string {
+	return fmt.Sprintf("sha256-%x", sha256.Sum256(b))
+}
+
+// legacyScore is how blobs were scored before scores said which hash made them
+func legacyScore(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// testStoreConformance runs the tests every store has to pass. Each test gets a new store from newStore.
+// Stores that are Aliasers also get testDeleteAlias.
+func testStoreConformance(t *testing.T, newStore func(t *testing.T) ContextStore) {
+	t.Run("PutGetDescribe", func(t *testing.T) { testPutGetDescribe(newStore(t), t) })
+	t.Run("GetRange", func(t *testing.T) { testGetRange(newStore(t), t) })
+	t.Run("Delete", func(t *testing.T) { testDelete(newStore(t), t) })
+	t.Run("DeleteAlias", func(t *testing.T) { testDeleteAlias(aliasStoreOrSkip(newStore(t), t), t) })
+	t.Run("AliasInUse", func(t *testing.T) { testAliasInUse(aliasStoreOrSkip(newStore(t), t), t) })
+	t.Run("Walk", func(t *testing.T) { testWalk(newStore(t), t) })
+	t.Run("ContextCancelled", func(t *testing.T) { testContextCancelled(newStore(t), t) })
+}
+
+func testPutGetDescribe(st Store, t *testing.T) {
+	blob := []byte("just give me the bytes")
+
+	_, err := st.Describe(score(blob))
+	if err == nil {
+		t.Errorf("st.Describe should have returned an error for a blob that is not in the store")
+	}
+
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	if a.Score != score(blob) {
+		t.Errorf("Score mismatched. Expected %q, got %q", score(blob), a.Score)
+	}
+
+	if a.Size != int64(len(blob)) {
+		t.Errorf("Size mismatched. Expected %d, got %d", len(blob), a.Size)
+	}
+
+	described, err := st.Describe(a.Score)
+	if err != nil {
+		t.Errorf("st.Describe returned an error for a blob in the store: %v", err)
+	}
+
+	if described != a {
+		t.Errorf("st.Describe returned a different address than st.Put. Expected %+v, got %+v", a, described)
+	}
+
+	again, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Errorf("st.Put returned an error putting a blob twice: %v", err)
+	}
+
+	if again != a {
+		t.Errorf("st.Put returned a different address putting a blob twice. Expected %+v, got %+v", a, again)
+	}
+
+	var buf bytes.Buffer
+	err = st.Get(a.Score, &buf)
+	if err != nil {
+		t.Errorf("st.Get returned an error: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Errorf("st.Get returned the wrong bytes. Expected %q, got %q", blob, buf.Bytes())
+	}
+
+	buf.Reset()
+	err = st.GetAddress(a, &buf)
+	if err != nil {
+		t.Errorf("st.GetAddress returned an error: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Errorf("st.GetAddress returned the wrong bytes. Expected %q, got %q", blob, buf.Bytes())
+	}
+
+	err = st.Get(score([]byte("not in the store")), &buf)
+	if err == nil {
+		t.Errorf("st.Get should have returned an error for a blob that is not in the store")
+	}
+}
+
+func testGetRange(st Store, t *testing.T) {
+	blob := []byte("0123456789abcdef")
+
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	tests := []struct {
+		off, n int64
+		want   string
+	}{
+		{0, 16, "0123456789abcdef"},
+		{0, 4, "0123"},
+		{10, 3, "abc"},
+		{12, 100, "cdef"},
+		{16, 10, ""},
+		{5, 0, ""},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := st.GetRange(a, tt.off, tt.n, &buf)
+		if err != nil {
+			t.Errorf("st.GetRange(%d, %d) returned an error: %v", tt.off, tt.n, err)
+			continue
+		}
+
+		if buf.String() != tt.want {
+			t.Errorf("st.GetRange(%d, %d) returned the wrong bytes. Expected %q, got %q", tt.off, tt.n, tt.want, buf.String())
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 4}, {17, 1}, {0, -1}} {
+		var buf bytes.Buffer
+		err := st.GetRange(a, r[0], r[1], &buf)
+		if err != ErrInvalidRange {
+			t.Errorf("st.GetRange(%d, %d) should have returned ErrInvalidRange, got %v", r[0], r[1], err)
+		}
+	}
+}
+
+func testDelete(st Store, t *testing.T) {
+	blob := []byte("a mistaken upload")
+
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	err = st.Delete(a.Score)
+	if err != nil {
+		t.Errorf("st.Delete returned an error: %v", err)
+	}
+
+	_, err = st.Describe(a.Score)
+	if err == nil {
+		t.Errorf("st.Describe should have returned an error for a deleted blob")
+	}
+
+	var buf bytes.Buffer
+	err = st.Get(a.Score, &buf)
+	if err == nil {
+		t.Errorf("st.Get should have returned an error for a deleted blob")
+	}
+
+	err = st.Delete(a.Score)
+	if err == nil {
+		t.Errorf("st.Delete should have returned an error for a blob that is not in the store")
+	}
+
+	// Putting it back should work
+	again, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error putting a deleted blob back: %v", err)
+	}
+
+	buf.Reset()
+	err = st.GetAddress(again, &buf)
+	if err != nil {
+		t.Errorf("st.GetAddress returned an error: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Errorf("st.GetAddress returned the wrong bytes. Expected %q, got %q", blob, buf.Bytes())
+	}
+}
+
+// aliasStore is a store that can add aliases
+type aliasStore interface {
+	Store
+	Aliaser
+}
+
+// aliasStoreOrSkip skips the test if st can't add aliases
+func aliasStoreOrSkip(st Store, t *testing.T) aliasStore {
+	as, ok := st.(aliasStore)
+	if !ok {
+		t.Skip("The store can't add aliases")
+	}
+	return as
+}
+
+// testDeleteAlias checks that a blob can't be deleted through an alias, and that its aliases stop working once it is deleted
+func testDeleteAlias(st aliasStore, t *testing.T) {
+	blob := []byte("called by another name")
+	a, err := st.Put(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	alias, err := HashScore("sha512", bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("HashScore returned an error: %v", err)
+	}
+
+	err = st.AddAlias(a.Score, alias)
+	if err != nil {
+		t.Fatalf("st.AddAlias returned an error: %v", err)
+	}
+
+	err = st.Delete(alias)
+	if err != ErrAlias {
+		t.Errorf("st.Delete should have returned ErrAlias for an alias, got %v", err)
+	}
+
+	_, err = st.Describe(a.Score)
+	if err != nil {
+		t.Errorf("Deleting through an alias should not have removed the blob, got %v", err)
+	}
+
+	err = st.Delete(a.Score)
+	if err != nil {
+		t.Fatalf("st.Delete returned an error: %v", err)
+	}
+
+	_, err = st.Describe(alias)
+	if err != ErrNotExist {
+		t.Errorf("The alias should not find a deleted blob, got %v", err)
+	}
+}
+
+// testAliasInUse checks that adding an alias again is harmless, but that it can't be moved to another blob
+func testAliasInUse(st aliasStore, t *testing.T) {
+	first, err := st.Put(bytes.NewReader([]byte("the first of its name")))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	second, err := st.Put(bytes.NewReader([]byte("the second of its name")))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	alias, err := HashScore("sha512", bytes.NewReader([]byte("the first of its name")))
+	if err != nil {
+		t.Fatalf("HashScore returned an error: %v", err)
+	}
+
+	for n := 0; n < 2; n++ {
+		err = st.AddAlias(first.Score, alias)
+		if err != nil {
+			t.Errorf("st.AddAlias returned an error: %v", err)
+		}
+	}
+
+	err = st.AddAlias(second.Score, alias)
+	if err != ErrAliasInUse {
+		t.Errorf("st.AddAlias should have returned ErrAliasInUse for an alias of another blob, got %v", err)
+	}
+
+	a, err := st.Describe(alias)
+	if err != nil || a.Score != first.Score {
+		t.Errorf("The alias should still name the first blob, got %+v, %v", a, err)
+	}
+
+	// Once the first blob is deleted, its alias can be given to another
+	err = st.Delete(first.Score)
+	if err != nil {
+		t.Errorf("st.Delete returned an error: %v", err)
+	}
+
+	err = st.AddAlias(second.Score, alias)
+	if err != nil {
+		t.Errorf("st.AddAlias should have taken the alias of a deleted blob, got %v", err)
+	}
+
+	a, err = st.Describe(alias)
+	if err != nil || a.Score != second.Score {
+		t.Errorf("The alias should name the second blob, got %+v, %v", a, err)
+	}
+
+	err = st.Delete(second.Score)
+	if err != nil {
+		t.Errorf("st.Delete returned an error: %v", err)
+	}
+}
+
+func testWalk(st Store, t *testing.T) {
+	want := make(map[string]Address)
+	for _, blob := range []string{"one", "two", "three"} {
+		a, err := st.Put(bytes.NewReader([]byte(blob)))
+		if err != nil {
+			t.Fatalf("st.Put returned an error: %v", err)
+		}
+		want[a.Score] = a
+	}
+
+	got := make(map[string]Address)
+	err := st.Walk(func(a Address) bool {
+		got[a.Score] = a
+		return true
+	})
+	if err != nil {
+		t.Errorf("st.Walk returned an error: %v", err)
+	}
+
+	for score, a := range want {
+		if got[score] != a {
+			t.Errorf("st.Walk should have listed %+v, got %+v", a, got[score])
+		}
+	}
+
+	count := 0
+	err = st.Walk(func(a Address) bool {
+		count++
+		return false
+	})
+	if err != nil {
+		t.Errorf("st.Walk returned an error: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("st.Walk should have stopped when fn returned false, but it called fn %d times", count)
+	}
+}
+
+func testContextCancelled(st ContextStore, t *testing.T) {
+	blob := []byte("never uploaded")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := st.PutContext(ctx, bytes.NewReader(bytes.Repeat(blob, 1<<16)))
+	if err == nil {
+		t.Errorf("st.PutContext should have returned an error with a cancelled context")
+	}
+
+	_, err = st.DescribeContext(ctx, score(blob))
+	if err == nil {
+		t.Errorf("st.DescribeContext should have returned an error with a cancelled context")
+	}
+
+	err = st.WalkContext(ctx, func(a Address) bool { return true })
+	if err == nil {
+		t.Errorf("st.WalkContext should have returned an error with a cancelled context")
+	}
+
+	_, err = st.Describe(score(bytes.Repeat(blob, 1<<16)))
+	if err == nil {
+		t.Errorf("The blob should not have been put with a cancelled context")
+	}
+}
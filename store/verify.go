@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// Verify re-reads the blob at Address a from st and checks that it still has the bytes that a describes.
+//
+// Verify returns ErrNotExist if the blob is not in the store, ErrTruncated if the store has a different number of bytes than a.Size, and ErrCorrupt if the bytes don't hash to a.Score.
+// Other errors, like not being able to reach the store, are returned as they are so they aren't mistaken for a missing blob.
+// Scores are checked with the hash algorithm they name, and legacy bare scores with sha256.
+func Verify(st Store, a Address) error {
+	return VerifiedCopy(st, a, ioutil.Discard)
+}
+
+// VerifiedCopy writes the blob at Address a from st to w, and checks it like Verify does. The bytes are written to w before they are checked.
+func VerifiedCopy(st Store, a Address, w io.Writer) error {
+	return VerifiedCopyContext(context.Background(), st, a, w)
+}
+
+// VerifiedCopyContext is VerifiedCopy with a context that is passed to st
+func VerifiedCopyContext(ctx context.Context, st Store, a Address, w io.Writer) error {
+	cst := withContext(st)
+	described, err := cst.DescribeContext(ctx, a.Score)
+	if isNotExist(err) {
+		return ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+
+	if described.Size != a.Size {
+		return ErrTruncated
+	}
+
+	algorithm, digest, err := ParseScore(a.Score)
+	if err != nil {
+		return err
+	}
+
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return err
+	}
+
+	c := &countingWriter{}
+	err = cst.GetAddressContext(ctx, a, io.MultiWriter(h, c, w))
+	if isNotExist(err) {
+		// The store's index has the blob, but its bytes are gone
+		return ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.n != a.Size {
+		return ErrTruncated
+	}
+
+	if fmt.Sprintf("%x", h.Sum(nil)) != digest {
+		return ErrCorrupt
+	}
+
+	return nil
+}
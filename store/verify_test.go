@@ -0,0 +1,99 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestVerify(t *testing.T) {
+	st := NewFileStore(t.TempDir())
+	blob := "bits rot, bytes shouldn't"
+
+	a, err := st.Put(strings.NewReader(blob))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	err = Verify(st, a)
+	if err != nil {
+		t.Errorf("Verify should not have returned an error for a good blob, got %v", err)
+	}
+
+	path, err := resolveFileUri(a.Location)
+	if err != nil {
+		t.Fatalf("Could not resolve location: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		contents string
+		want     error
+	}{
+		{"Corrupt", strings.ToUpper(blob), ErrCorrupt},
+		{"Truncated", blob[:10], ErrTruncated},
+		{"Longer", blob + "!", ErrTruncated},
+	}
+
+	for _, tt := range tests {
+		err = os.Chmod(path, 0644)
+		if err != nil {
+			t.Fatalf("Could not chmod blob: %v", err)
+		}
+
+		err = ioutil.WriteFile(path, []byte(tt.contents), 0644)
+		if err != nil {
+			t.Fatalf("Could not write blob: %v", err)
+		}
+
+		err = Verify(st, a)
+		if err != tt.want {
+			t.Errorf("%s: Verify should have returned %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatalf("Could not remove blob: %v", err)
+	}
+
+	err = Verify(st, a)
+	if err != ErrNotExist {
+		t.Errorf("Verify should have returned ErrNotExist for a missing blob, got %v", err)
+	}
+}
+
+// unreachableStore is a store that has the blob in its index, but can't read its bytes
+type unreachableStore struct {
+	Store
+	err error
+}
+
+func (s unreachableStore) GetAddress(a Address, w io.Writer) error {
+	return s.err
+}
+
+func TestVerifyStoreErrors(t *testing.T) {
+	st := NewFileStore(t.TempDir())
+
+	a, err := st.Put(strings.NewReader("out of reach"))
+	if err != nil {
+		t.Fatalf("st.Put returned an error: %v", err)
+	}
+
+	unreachable := errors.New("connection refused")
+	err = Verify(unreachableStore{st, unreachable}, a)
+	if err != unreachable {
+		t.Errorf("Verify should have returned the store's error, got %v", err)
+	}
+
+	err = Verify(unreachableStore{st, awserr.New("NoSuchKey", "The specified key does not exist.", nil)}, a)
+	if err != ErrNotExist {
+		t.Errorf("Verify should have returned ErrNotExist for a missing S3 object, got %v", err)
+	}
+}